@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const DEFAULT_PROCESS_TYPE = "web"
+
+type ProcessInfo struct {
+	Guid   string         `json:"guid"`
+	Type   string         `json:"type"`
+	Errors []ProcessError `json:"errors"`
+}
+type ProcessStats struct {
+	Resources []ProcessInstance `json:"resources"`
+	Errors    []ProcessError    `json:"errors"`
+}
+type ProcessInstance struct {
+	Index  int    `json:"index"`
+	State  string `json:"state"`
+	Uptime int64  `json:"uptime"`
+}
+type ProcessError struct {
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+// getProcessGuid retrieves through v3 api the guid of the process of the app, it's used as ssh user instead of app guid.
+func (s SyncCommand) getProcessGuid(appGuid, processType string) (string, error) {
+	var processInfo ProcessInfo
+	err := s.curl(fmt.Sprintf("/v3/apps/%s/processes/%s", appGuid, processType), &processInfo)
+	if err != nil {
+		return "", err
+	}
+	if len(processInfo.Errors) > 0 {
+		return "", fmt.Errorf("Process '%s' can't be found: %s", processType, processInfo.Errors[0].Detail)
+	}
+	return processInfo.Guid, nil
+}
+
+// getProcessInstances gives the start time of each running instance of a process by index.
+func (s SyncCommand) getProcessInstances(processGuid string) (map[int]time.Time, error) {
+	var processStats ProcessStats
+	err := s.curl(fmt.Sprintf("/v3/processes/%s/stats", processGuid), &processStats)
+	if err != nil {
+		return nil, err
+	}
+	if len(processStats.Errors) > 0 {
+		return nil, fmt.Errorf("Instances of process can't be retrieved: %s", processStats.Errors[0].Detail)
+	}
+	running := make(map[int]time.Time)
+	now := time.Now()
+	for _, instance := range processStats.Resources {
+		if strings.ToUpper(instance.State) == "RUNNING" {
+			running[instance.Index] = now.Add(-time.Duration(instance.Uptime) * time.Second)
+		}
+	}
+	return running, nil
+}
+
+// getAppInstances gives the start time of each running instance of the web process by index.
+func (s SyncCommand) getAppInstances(appName string) (map[int]time.Time, error) {
+	app, err := s.cliConnection.GetApp(appName)
+	if err != nil {
+		return nil, err
+	}
+	running := make(map[int]time.Time)
+	if len(app.Instances) == 0 {
+		for i := 0; i < app.RunningInstances; i++ {
+			running[i] = time.Time{}
+		}
+		return running, nil
+	}
+	for i, instance := range app.Instances {
+		if strings.ToLower(instance.State) == "running" {
+			running[i] = instance.Since
+		}
+	}
+	return running, nil
+}
+func (s SyncCommand) curl(path string, v interface{}) error {
+	data, err := s.cliConnection.CliCommandWithoutTerminalOutput("curl", path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(strings.Join(data, "")), v)
+}
+
+// CheckInstanceRunning returns an error listing running instances when instance index is not one of them.
+func CheckInstanceRunning(index int, processType string, running map[int]time.Time) error {
+	if _, ok := running[index]; ok {
+		return nil
+	}
+	if len(running) == 0 {
+		return fmt.Errorf("Instance %d of process '%s' is not running, process has no running instance.", index, processType)
+	}
+	indexes := make([]string, 0, len(running))
+	for _, i := range sortedIndexes(running) {
+		indexes = append(indexes, fmt.Sprintf("%d", i))
+	}
+	return fmt.Errorf("Instance %d of process '%s' is not running, running instances are: %s.", index, processType, strings.Join(indexes, ", "))
+}
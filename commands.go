@@ -18,10 +18,99 @@ func generateCommand(c *SyncCommand) []cli.Command {
 					Name: "target, t",
 					Usage: "Directory which will be sync from container.",
 				},
+				cli.StringSliceFlag{
+					Name: "map, m",
+					Usage: "Synchronize a source directory with a directory of the container, written as local:remote. Can be repeated, it replaces --source and --target.",
+				},
 				cli.BoolFlag{
 					Name: "force-sync, f",
 					Usage: "Resynchronize files from remote to source even if source folder is not empty.",
 				},
+				cli.BoolFlag{
+					Name: "checksum, c",
+					Usage: "Compare files content with a hash when source folder is reconciled with remote folder.",
+				},
+				cli.BoolFlag{
+					Name: "plan",
+					Usage: "Only print files which would be downloaded, uploaded or are in conflict, then exit.",
+				},
+				cli.StringFlag{
+					Name: "conflict",
+					Value: CONFLICT_LOCAL_WINS,
+					Usage: "Policy to apply when a file changed in source folder and in container since last synchronization: local-wins, remote-wins, keep-both (remote version is written in a .conflict file) or ask.",
+				},
+				cli.DurationFlag{
+					Name: "debounce",
+					Value: DEFAULT_DEBOUNCE,
+					Usage: "Quiet window during which events on the same file are grouped before being sent, 0 to send each event.",
+				},
+				cli.IntFlag{
+					Name: "parallel, p",
+					Value: 1,
+					Usage: "Number of files which can be sent at the same time, changes on the same file or folder are always sent in order.",
+				},
+				cli.BoolFlag{
+					Name: "delta",
+					Usage: "Only send changed blocks of files which already exist in container.",
+				},
+				cli.BoolFlag{
+					Name: "tar",
+					Usage: "Transfer files in bulk through a tar stream when synchronizing folders (tar command must be available in container).",
+				},
+				cli.BoolFlag{
+					Name: "compress, z",
+					Usage: "Compress tar stream used by --tar.",
+				},
+				cli.BoolFlag{
+					Name: "dry-run",
+					Usage: "Print what would be downloaded, uploaded, renamed or deleted without changing anything in container or in source folder.",
+				},
+				cli.BoolFlag{
+					Name: "bidirectional, b",
+					Usage: "Also watch for change in the container directory and write them in source directory.",
+				},
+				cli.DurationFlag{
+					Name: "poll-interval",
+					Value: DEFAULT_POLL_INTERVAL,
+					Usage: "Interval between two scans of the container directory when inotifywait is not available in container.",
+				},
+				cli.IntFlag{
+					Name: "instance, i",
+					Value: 0,
+					Usage: "Index of the instance to synchronize.",
+				},
+				cli.StringFlag{
+					Name: "process",
+					Value: DEFAULT_PROCESS_TYPE,
+					Usage: "Type of the process to synchronize (e.g. worker), its instances are targeted instead of instances of the web process.",
+				},
+				cli.BoolFlag{
+					Name: "all-instances",
+					Usage: "Send changes to every running instance of the app instead of only the first one.",
+				},
+				cli.StringFlag{
+					Name: "symlinks",
+					Value: SYMLINKS_FOLLOW,
+					Usage: "How symlinks are synchronized: follow (content they point to is copied) or preserve (symlinks are recreated).",
+				},
+				cli.StringFlag{
+					Name: "umask",
+					Usage: "Octal umask (e.g. 022) applied to permissions of files copied in both directions, by default permissions are kept as is.",
+				},
+				cli.IntFlag{
+					Name: "max-delete",
+					Value: DEFAULT_MAX_DELETE,
+					Usage: "Maximum number of entries deleted in container when a folder is removed, 0 means no limit.",
+				},
+				cli.BoolFlag{
+					Name: "debug",
+					Usage: "Show debug logs, e.g. local events skipped because they match ignore rules.",
+				},
+				cli.StringFlag{
+					Name: "editors",
+					Value: DefaultEditors(),
+					Usage: "Comma separated editors whose saves are recognised (vim, emacs, jetbrains, atomic), their temporary files are not synchronized and a saved file is sent once, none disables it.",
+				},
 			},
 			Description: "Synchronize a folder to a container directory by default a sync-appname folder will be created in current dir and target dir will be set to ~/app",
 			Action: c.Sync,
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const CONFIG_FILENAME = ".cfsync.yml"
+
+var configErrorLine *regexp.Regexp = regexp.MustCompile(`line (\d+): (.*)`)
+
+// Config is the content of a .cfsync.yml file, options which are not set keep the value of command line flags.
+type Config struct {
+	App          string          `yaml:"app"`
+	Mappings     []ConfigMapping `yaml:"mappings"`
+	Ignore       []string        `yaml:"ignore"`
+	Instance     *int            `yaml:"instance"`
+	Process      string          `yaml:"process"`
+	AllInstances *bool           `yaml:"all-instances"`
+	Checksum     *bool           `yaml:"checksum"`
+	Conflict     string          `yaml:"conflict"`
+	Debounce     *time.Duration  `yaml:"debounce"`
+	Parallel     *int            `yaml:"parallel"`
+	Delta        *bool           `yaml:"delta"`
+	Tar          *bool           `yaml:"tar"`
+	Compress     *bool           `yaml:"compress"`
+	Bidirectional *bool          `yaml:"bidirectional"`
+	PollInterval *time.Duration  `yaml:"poll-interval"`
+	Symlinks     string          `yaml:"symlinks"`
+	Umask        string          `yaml:"umask"`
+	MaxDelete    *int            `yaml:"max-delete"`
+	Editors      []string        `yaml:"editors"`
+	Hooks        []ConfigHook    `yaml:"hooks"`
+	BuildHooks   []ConfigBuildHook `yaml:"build-hooks"`
+
+	path    string
+	content []byte
+}
+type ConfigMapping struct {
+	Source string   `yaml:"source"`
+	Target string   `yaml:"target"`
+	Ignore []string `yaml:"ignore"`
+}
+
+// ConfigHook is a command run in the container after files matching On have been uploaded,
+// On is relative to the root folder of the app.
+type ConfigHook struct {
+	On  string `yaml:"on"`
+	Run string `yaml:"run"`
+}
+
+// ConfigBuildHook is a local command run before uploading files matching On, On and Outputs are relative
+// to the source folder of the mapping.
+type ConfigBuildHook struct {
+	On      string   `yaml:"on"`
+	Run     string   `yaml:"run"`
+	Outputs []string `yaml:"outputs"`
+}
+
+// ConfigError is a validation error of the configuration file pointing to the bad key.
+type ConfigError struct {
+	Path string
+	Key  string
+	Line int
+	Msg  string
+}
+
+func (e ConfigError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("Invalid key '%s' in '%s': %s", e.Key, e.Path, e.Msg)
+	}
+	return fmt.Sprintf("Invalid key '%s' at line %d of '%s': %s", e.Key, e.Line, e.Path, e.Msg)
+}
+
+// FindConfig searches the configuration file in working directory and its parents,
+// nil is returned when there is none.
+func FindConfig() (*Config, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		configPath := filepath.Join(dir, CONFIG_FILENAME)
+		exists, err := FileExists(configPath)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return LoadConfig(configPath)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+func LoadConfig(configPath string) (*Config, error) {
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{
+		path: configPath,
+		content: content,
+	}
+	err = yaml.UnmarshalStrict(content, config)
+	if err != nil {
+		return nil, config.toConfigError(err)
+	}
+	err = config.validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// exclusiveFlags gives the flag which can't be used with each flag.
+var exclusiveFlags map[string]string = map[string]string{
+	"instance": "all-instances",
+	"all-instances": "instance",
+}
+
+// Apply sets flags which have not been passed in command line with values of the configuration file.
+// A value is not applied when it conflicts with a flag passed in command line (e.g. instance with --all-instances),
+// the flag passed in command line wins.
+func (c Config) Apply(context *cli.Context) error {
+	flags := map[string]string{
+		"process": c.Process,
+		"conflict": c.Conflict,
+		"symlinks": c.Symlinks,
+		"umask": c.Umask,
+	}
+	if c.Editors != nil {
+		flags["editors"] = strings.Join(c.Editors, ",")
+		if len(c.Editors) == 0 {
+			flags["editors"] = EDITORS_NONE
+		}
+	}
+	setInt := func(name string, value *int) {
+		if value != nil {
+			flags[name] = strconv.Itoa(*value)
+		}
+	}
+	setBool := func(name string, value *bool) {
+		if value != nil {
+			flags[name] = strconv.FormatBool(*value)
+		}
+	}
+	setDuration := func(name string, value *time.Duration) {
+		if value != nil {
+			flags[name] = value.String()
+		}
+	}
+	setInt("instance", c.Instance)
+	setInt("parallel", c.Parallel)
+	setInt("max-delete", c.MaxDelete)
+	setBool("all-instances", c.AllInstances)
+	setBool("checksum", c.Checksum)
+	setBool("delta", c.Delta)
+	setBool("tar", c.Tar)
+	setBool("compress", c.Compress)
+	setBool("bidirectional", c.Bidirectional)
+	setDuration("debounce", c.Debounce)
+	setDuration("poll-interval", c.PollInterval)
+	// applied values make flags set too, so command line flags are known before applying anything
+	passed := make(map[string]bool)
+	for name := range flags {
+		passed[name] = context.IsSet(name)
+	}
+	for name := range exclusiveFlags {
+		passed[name] = context.IsSet(name)
+	}
+	for name, value := range flags {
+		if value == "" || passed[name] {
+			continue
+		}
+		if conflicting, ok := exclusiveFlags[name]; ok && passed[conflicting] {
+			continue
+		}
+		err := context.Set(name, value)
+		if err != nil {
+			return c.errorAt(name, err.Error())
+		}
+	}
+	return nil
+}
+
+// GetMappings gives mappings of the configuration file, relative source folders are relative to the file.
+// Missing source folders are created, unless dryRun is true.
+func (c Config) GetMappings(dryRun bool) ([]Mapping, error) {
+	mappings := make([]Mapping, 0, len(c.Mappings))
+	for _, configMapping := range c.Mappings {
+		source := configMapping.Source
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(filepath.Dir(c.path), source)
+		}
+		sourceDir, err := toSourceDir(source, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, Mapping{SourceDir: sourceDir, TargetDir: toTargetDir(configMapping.Target)})
+	}
+	return mappings, nil
+}
+
+// IgnorePatterns gives ignore patterns of the configuration file which apply to the mapping targeting targetDir.
+func (c Config) IgnorePatterns(targetDir string) []string {
+	patterns := append([]string{}, c.Ignore...)
+	for _, configMapping := range c.Mappings {
+		if toTargetDir(configMapping.Target) == targetDir {
+			patterns = append(patterns, configMapping.Ignore...)
+		}
+	}
+	return patterns
+}
+
+// RemoteHooks gives hooks of the configuration file.
+func (c Config) RemoteHooks() []RemoteHook {
+	hooks := make([]RemoteHook, 0, len(c.Hooks))
+	for _, configHook := range c.Hooks {
+		hooks = append(hooks, RemoteHook{Pattern: configHook.On, Command: configHook.Run})
+	}
+	return hooks
+}
+
+// GetBuildHooks gives build hooks of the configuration file.
+func (c Config) GetBuildHooks() []BuildHook {
+	hooks := make([]BuildHook, 0, len(c.BuildHooks))
+	for _, configHook := range c.BuildHooks {
+		hooks = append(hooks, BuildHook{Pattern: configHook.On, Command: configHook.Run, Outputs: configHook.Outputs})
+	}
+	return hooks
+}
+func (c Config) Path() string {
+	return c.path
+}
+func (c Config) validate() error {
+	if c.Conflict != "" {
+		err := CheckConflictPolicy(c.Conflict)
+		if err != nil {
+			return c.errorAt("conflict", err.Error())
+		}
+	}
+	if c.Symlinks != "" {
+		err := CheckSymlinkMode(c.Symlinks)
+		if err != nil {
+			return c.errorAt("symlinks", err.Error())
+		}
+	}
+	_, err := ParseUmask(c.Umask)
+	if err != nil {
+		return c.errorAt("umask", err.Error())
+	}
+	_, err = ParseEditors(strings.Join(c.Editors, ","))
+	if err != nil {
+		return c.errorAt("editors", err.Error())
+	}
+	if c.Instance != nil && *c.Instance < 0 {
+		return c.errorAt("instance", "instance must be a positive index.")
+	}
+	if c.Instance != nil && c.AllInstances != nil && *c.AllInstances {
+		return c.errorAt("instance", "instance can't be used with all-instances.")
+	}
+	if c.Parallel != nil && *c.Parallel < 1 {
+		return c.errorAt("parallel", "at least one file must be sent at a time.")
+	}
+	if c.MaxDelete != nil && *c.MaxDelete < 0 {
+		return c.errorAt("max-delete", "limit must be positive, 0 means no limit.")
+	}
+	if c.Debounce != nil && *c.Debounce < 0 {
+		return c.errorAt("debounce", "duration must be positive.")
+	}
+	if c.PollInterval != nil && *c.PollInterval <= 0 {
+		return c.errorAt("poll-interval", "duration must be greater than 0.")
+	}
+	for i, configMapping := range c.Mappings {
+		if configMapping.Source == "" {
+			return c.errorAt(fmt.Sprintf("mappings[%d].source", i), "source folder is missing.")
+		}
+		if configMapping.Target == "" {
+			return c.errorAt(fmt.Sprintf("mappings[%d].target", i), "target folder is missing.")
+		}
+	}
+	for i, configHook := range c.Hooks {
+		if configHook.On == "" {
+			return c.errorAt(fmt.Sprintf("hooks[%d].on", i), "pattern of changed files is missing.")
+		}
+		if configHook.Run == "" {
+			return c.errorAt(fmt.Sprintf("hooks[%d].run", i), "command to run is missing.")
+		}
+	}
+	for i, configHook := range c.BuildHooks {
+		if configHook.On == "" {
+			return c.errorAt(fmt.Sprintf("build-hooks[%d].on", i), "pattern of changed files is missing.")
+		}
+		if configHook.Run == "" {
+			return c.errorAt(fmt.Sprintf("build-hooks[%d].run", i), "command to run is missing.")
+		}
+	}
+	return nil
+}
+
+// toConfigError converts an error of yaml parser, which only gives a line, to an error naming the key of this line.
+func (c Config) toConfigError(err error) error {
+	msg := err.Error()
+	if typeError, ok := err.(*yaml.TypeError); ok && len(typeError.Errors) > 0 {
+		msg = typeError.Errors[0]
+	}
+	matches := configErrorLine.FindStringSubmatch(msg)
+	if matches == nil {
+		return fmt.Errorf("Invalid configuration file '%s': %s", c.path, msg)
+	}
+	line, _ := strconv.Atoi(matches[1])
+	msg = matches[2]
+	if strings.Contains(msg, "not found in type") {
+		msg = "unknown key."
+	}
+	return ConfigError{
+		Path: c.path,
+		Key: c.keyAt(line),
+		Line: line,
+		Msg: msg,
+	}
+}
+func (c Config) errorAt(key, msg string) error {
+	return ConfigError{
+		Path: c.path,
+		Key: key,
+		Line: c.lineOf(key),
+		Msg: msg,
+	}
+}
+
+// keyAt gives the key written at line (starting from 1).
+func (c Config) keyAt(line int) string {
+	lines := strings.Split(string(c.content), "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	key := strings.TrimSpace(lines[line - 1])
+	key = strings.TrimSpace(strings.TrimPrefix(key, "-"))
+	return strings.TrimSpace(strings.SplitN(key, ":", 2)[0])
+}
+
+// lineOf gives the line (starting from 1) where key is written, keys of list items are written as list[i].key,
+// line of the item is given when its key is missing.
+func (c Config) lineOf(key string) int {
+	lines := strings.Split(string(c.content), "\n")
+	name := key
+	list := ""
+	item := -1
+	if i := strings.Index(key, "["); i > 0 {
+		list = key[:i]
+		fmt.Sscanf(key[i:], "[%d].", &item)
+		name = key[strings.Index(key, ".") + 1:]
+	}
+	inList := false
+	itemIndent := -1
+	itemLine := 0
+	nbItems := -1
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if item < 0 {
+			if indent == 0 && strings.HasPrefix(trimmed, name + ":") {
+				return i + 1
+			}
+			continue
+		}
+		if indent == 0 && !strings.HasPrefix(trimmed, "-") {
+			inList = strings.HasPrefix(trimmed, list + ":")
+			continue
+		}
+		if !inList {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "-") && (itemIndent < 0 || indent == itemIndent) {
+			itemIndent = indent
+			nbItems++
+			if nbItems == item {
+				itemLine = i + 1
+			}
+			trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, "-"))
+		}
+		if nbItems == item && strings.HasPrefix(trimmed, name + ":") {
+			return i + 1
+		}
+	}
+	return itemLine
+}
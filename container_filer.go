@@ -1,17 +1,45 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"time"
 )
 
 type ContainerFiler interface {
 	CopyRemoteFolder(sourceDir, targetDir string) error
-	CopyContent(reader io.Reader, length int64, remotePath string, permissions os.FileMode) error
+	CopyContent(reader io.Reader, length int64, remotePath string, permissions os.FileMode, modTime time.Time) error
 	CreateFolders(remotePath, dir string) error
+	MakeDir(remotePath string, permissions os.FileMode) error
 	Delete(remotePath string) error
 	Rename(srcRmtPath, trtRmtPath string) error
+	ListRemoteFiles(targetDir string) (map[string]os.FileInfo, error)
+	Download(remotePath, localPath string) error
+	DownloadFiles(sourceDir, targetDir string, paths []string) error
+	UploadFiles(sourceDir, targetDir string, paths []string) error
+	Hash(remotePath string) (string, error)
+	Stat(remotePath string) (os.FileInfo, error)
+	Symlink(target, remotePath string) error
+	ReadLink(remotePath string) (string, error)
 	SetWriter(writer io.Writer)
 }
 
+// FilesError is returned by operations on several files when some of them have failed, the others have been done.
+// Paths are the ones given to the operation, Err is the last error.
+type FilesError struct {
+	Paths []string
+	Err   error
+}
+
+func (e *FilesError) Error() string {
+	return fmt.Sprintf("%d file(s) have failed, last error: %s", len(e.Paths), e.Err.Error())
+}
 
+// failedPaths gives paths which have failed according to err, every path when it's not a FilesError.
+func failedPaths(err error, paths []string) []string {
+	if filesError, ok := err.(*FilesError); ok {
+		return filesError.Paths
+	}
+	return paths
+}
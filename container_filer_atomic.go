@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// TEMP_FILE_PREFIX is the prefix of files, and staging folders of tar uploads, being uploaded, they are moved
+// in place when upload is finished.
+const TEMP_FILE_PREFIX = ".cfsync-tmp-"
+
+func tempPathFor(remotePath string) string {
+	return path.Dir(remotePath) + "/" + TEMP_FILE_PREFIX + fmt.Sprintf("%d-", time.Now().UnixNano()) + path.Base(remotePath)
+}
+
+// isTempFile tells if remotePath is a temporary file or is inside a staging folder.
+func isTempFile(remotePath string) bool {
+	return strings.HasPrefix(path.Base(remotePath), TEMP_FILE_PREFIX) || strings.Contains("/" + remotePath, "/" + TEMP_FILE_PREFIX)
+}
+
+// moveInPlace replaces remotePath by tempPath in one step with posix-rename extension, when server doesn't support it
+// remotePath is removed before renaming.
+func (f ContainerFilerSftp) moveInPlace(tempPath, remotePath string) error {
+	err := f.client.PosixRename(tempPath, remotePath)
+	if err == nil {
+		return nil
+	}
+	err = f.client.Rename(tempPath, remotePath)
+	if err == nil {
+		return nil
+	}
+	f.client.Remove(remotePath)
+	err = f.client.Rename(tempPath, remotePath)
+	if err != nil {
+		f.client.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// copyToTemp copies remotePath to a temporary file inside the container, to modify it without touching remotePath.
+func (f ContainerFilerSftp) copyToTemp(remotePath string) (string, error) {
+	if f.secureClient == nil {
+		return "", fmt.Errorf("No ssh client to copy file.")
+	}
+	session, err := f.secureClient.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	tempPath := tempPathFor(remotePath)
+	output, err := session.CombinedOutput("cp -p " + ShellQuote(remotePath) + " " + ShellQuote(tempPath))
+	if err != nil {
+		f.client.Remove(tempPath)
+		msg := strings.TrimSpace(string(output))
+		if msg == "" {
+			return "", err
+		}
+		return "", fmt.Errorf("%s (cp: %s)", err.Error(), msg)
+	}
+	return tempPath, nil
+}
+
+// CleanTempFiles removes temporary files left in targetDir by uploads interrupted in a previous session.
+func (f ContainerFilerSftp) CleanTempFiles(targetDir string) error {
+	targetDir = strings.TrimSuffix(targetDir, "/")
+	walker := f.client.Walk(targetDir)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if walker.Path() == targetDir {
+				return err
+			}
+			continue
+		}
+		isDir := walker.Stat().IsDir()
+		if isDir && walker.Path() != targetDir && f.syncIgnore.Match(walker.Path(), true) {
+			walker.SkipDir()
+			continue
+		}
+		if walker.Path() == targetDir || !isTempFile(walker.Path()) {
+			continue
+		}
+		var err error
+		if isDir {
+			walker.SkipDir()
+			err = f.removeEntries(walker.Path())
+		} else {
+			err = f.client.Remove(walker.Path())
+		}
+		if err != nil {
+			logger.Warning("Temporary file '%s' can't be removed: %s", TruncatePath(walker.Path()), err.Error())
+			continue
+		}
+		logger.Info("Temporary file '%s' left by a previous session removed.", TruncatePath(walker.Path()))
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// DEFAULT_MAX_DELETE is the maximum number of entries deleted in container when a folder is removed.
+const DEFAULT_MAX_DELETE = 1000
+
+// removeTree deletes a remote folder and its content depth-first, nothing is deleted when the folder
+// contains more entries than the limit. Symlinks are deleted, not followed.
+func (f ContainerFilerSftp) removeTree(remotePath string) error {
+	nbEntries, err := f.countEntries(remotePath)
+	if err != nil {
+		return err
+	}
+	if f.maxDelete > 0 && nbEntries > f.maxDelete {
+		return fmt.Errorf("Folder '%s' contains %d entries, more than the limit of %d, it has not been deleted (see --max-delete).",
+			remotePath, nbEntries, f.maxDelete)
+	}
+	if nbEntries > 0 {
+		logger.Info("Deleting %d entries of folder '%s' ...", nbEntries, TruncatePath(remotePath))
+	}
+	return f.removeEntries(remotePath)
+}
+
+// countEntries counts files and folders inside remotePath, counting stops once the limit is exceeded.
+func (f ContainerFilerSftp) countEntries(remotePath string) (int, error) {
+	entries, err := f.client.ReadDir(remotePath)
+	if err != nil {
+		return 0, err
+	}
+	nbEntries := len(entries)
+	for _, entry := range entries {
+		if f.maxDelete > 0 && nbEntries > f.maxDelete {
+			break
+		}
+		if !entry.IsDir() {
+			continue
+		}
+		nbChildren, err := f.countEntries(remotePath + "/" + entry.Name())
+		if err != nil {
+			return 0, err
+		}
+		nbEntries += nbChildren
+	}
+	return nbEntries, nil
+}
+func (f ContainerFilerSftp) removeEntries(remotePath string) error {
+	entries, err := f.client.ReadDir(remotePath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		childPath := remotePath + "/" + entry.Name()
+		if entry.IsDir() {
+			err = f.removeEntries(childPath)
+		} else {
+			err = f.client.Remove(childPath)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return f.client.RemoveDirectory(remotePath)
+}
+func (f *ContainerFilerSftp) SetMaxDelete(maxDelete int) {
+	f.maxDelete = maxDelete
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DELTA_BLOCK_SIZE = 64 * 1024
+
+// CKSUM_POLY is the crc polynomial used by cksum command, weak checksums are computed like cksum does
+// so that the container can compute them with standard tools.
+const CKSUM_POLY = 0x04C11DB7
+
+var cksumTable [256]uint32 = makeCksumTable()
+
+// cksumOutTable removes the first byte of a window of DELTA_BLOCK_SIZE bytes from its rolling checksum.
+var cksumOutTable [256]uint32 = makeCksumOutTable()
+
+// blockSum is the weak (cksum) and strong (md5) checksums of a block of the remote file.
+type blockSum struct {
+	weak   uint32
+	strong string
+	full   bool
+}
+
+// deltaRun is a run of count remote blocks, starting at block, found at offset of the local file.
+type deltaRun struct {
+	offset int64
+	block  int
+	count  int
+}
+
+// copyContentDelta only sends parts of the local file which are not found in the remote file, blocks of the remote
+// file are matched at any offset of the local file with a rolling checksum (like rsync).
+// It returns false when remote file can't be used as a base and the whole file must be sent.
+func (f ContainerFilerSftp) copyContentDelta(reader io.ReaderAt, length int64, remotePath string, permissions os.FileMode, modTime time.Time) (bool, error) {
+	remoteStat, err := f.client.Stat(remotePath)
+	if err != nil || remoteStat.IsDir() || remoteStat.Size() < DELTA_BLOCK_SIZE {
+		return false, nil
+	}
+	remoteSums, err := f.remoteBlockSums(remotePath, remoteStat.Size())
+	if err != nil {
+		return false, err
+	}
+	runs, err := matchBlocks(reader, length, remoteSums)
+	if err != nil || len(runs) == 0 {
+		return false, err
+	}
+	// file is rebuilt in a temporary file from blocks of remote file which is then moved in place
+	tempPath, err := f.assembleTemp(remotePath, runs)
+	if err != nil {
+		return false, err
+	}
+	sent, err := f.writeLiterals(reader, length, tempPath, runs)
+	if err == nil {
+		err = f.setRemoteAttributes(tempPath, permissions, modTime)
+	}
+	if err != nil {
+		f.client.Remove(tempPath)
+		return false, err
+	}
+	err = f.moveInPlace(tempPath, remotePath)
+	if err != nil {
+		return false, err
+	}
+	logger.Info("Delta upload of file '%s': %d bytes sent instead of %d (%d bytes saved).",
+		TruncatePath(remotePath), sent, length, length - sent)
+	return true, nil
+}
+
+// assembleTemp copies remotePath to a temporary file and copies inside it remote blocks which have moved,
+// it's done by a single script run in the container.
+func (f ContainerFilerSftp) assembleTemp(remotePath string, runs []deltaRun) (string, error) {
+	if f.secureClient == nil {
+		return "", fmt.Errorf("No ssh client to copy file.")
+	}
+	session, err := f.secureClient.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	tempPath := tempPathFor(remotePath)
+	script := &bytes.Buffer{}
+	fmt.Fprintf(script, "set -e\ncp -p %s %s\n", ShellQuote(remotePath), ShellQuote(tempPath))
+	for _, run := range runs {
+		if run.offset == int64(run.block) * DELTA_BLOCK_SIZE {
+			continue
+		}
+		fmt.Fprintf(script, "dd if=%s of=%s bs=%d skip=%d count=%d seek=%d oflag=seek_bytes conv=notrunc 2>/dev/null\n",
+			ShellQuote(remotePath), ShellQuote(tempPath), DELTA_BLOCK_SIZE, run.block, run.count, run.offset)
+	}
+	session.Stdin = script
+	output, err := session.CombinedOutput("sh -s")
+	if err != nil {
+		f.client.Remove(tempPath)
+		msg := strings.TrimSpace(string(output))
+		if msg == "" {
+			return "", err
+		}
+		return "", fmt.Errorf("%s (sh: %s)", err.Error(), msg)
+	}
+	return tempPath, nil
+}
+
+// writeLiterals writes in remotePath parts of the local file which are not covered by runs and gives the number
+// of bytes sent.
+func (f ContainerFilerSftp) writeLiterals(reader io.ReaderAt, length int64, remotePath string, runs []deltaRun) (int64, error) {
+	remoteFile, err := f.client.OpenFile(remotePath, os.O_WRONLY)
+	if err != nil {
+		return 0, err
+	}
+	defer remoteFile.Close()
+
+	var sent int64
+	writeRange := func(start, end int64) error {
+		if start >= end {
+			return nil
+		}
+		_, err := remoteFile.Seek(start, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(remoteFile, io.NewSectionReader(reader, start, end - start))
+		sent += n
+		return err
+	}
+	offset := int64(0)
+	for _, run := range runs {
+		err = writeRange(offset, run.offset)
+		if err != nil {
+			return sent, err
+		}
+		offset = run.offset + int64(run.count) * DELTA_BLOCK_SIZE
+	}
+	err = writeRange(offset, length)
+	if err != nil {
+		return sent, err
+	}
+	return sent, remoteFile.Truncate(length)
+}
+
+// matchBlocks finds full blocks of the remote file in the local file, at any offset, and gives them as runs of
+// consecutive blocks ordered by offset.
+func matchBlocks(reader io.ReaderAt, length int64, remoteSums []blockSum) ([]deltaRun, error) {
+	index := make(map[uint32][]int)
+	for i, sum := range remoteSums {
+		if sum.full {
+			index[sum.weak] = append(index[sum.weak], i)
+		}
+	}
+	runs := make([]deltaRun, 0)
+	addMatch := func(offset int64, block int) {
+		if len(runs) > 0 {
+			last := &runs[len(runs) - 1]
+			if last.offset + int64(last.count) * DELTA_BLOCK_SIZE == offset && last.block + last.count == block {
+				last.count++
+				return
+			}
+		}
+		runs = append(runs, deltaRun{offset: offset, block: block, count: 1})
+	}
+
+	in := bufio.NewReaderSize(io.NewSectionReader(reader, 0, length), DELTA_BLOCK_SIZE)
+	window := make([]byte, DELTA_BLOCK_SIZE)
+	offset := int64(0)
+	for offset + DELTA_BLOCK_SIZE <= length {
+		_, err := io.ReadFull(in, window)
+		if err != nil {
+			return nil, err
+		}
+		// window is a ring buffer starting at start
+		start := 0
+		crc := updateCksum(0, window)
+		for {
+			block, ok := findBlock(index, remoteSums, finishCksum(crc, DELTA_BLOCK_SIZE), window, start, offset)
+			if ok {
+				addMatch(offset, block)
+				offset += DELTA_BLOCK_SIZE
+				break
+			}
+			if offset + DELTA_BLOCK_SIZE >= length {
+				return runs, nil
+			}
+			b, err := in.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			crc = rollCksum(crc, window[start], b)
+			window[start] = b
+			start = (start + 1) % DELTA_BLOCK_SIZE
+			offset++
+		}
+	}
+	return runs, nil
+}
+
+// findBlock gives the remote block which has the same content as the window, a block at the same offset is
+// preferred as it doesn't need to be copied.
+func findBlock(index map[uint32][]int, remoteSums []blockSum, weak uint32, window []byte, start int, offset int64) (int, bool) {
+	candidates, ok := index[weak]
+	if !ok {
+		return 0, false
+	}
+	hash := md5.New()
+	hash.Write(window[start:])
+	hash.Write(window[:start])
+	strong := hex.EncodeToString(hash.Sum(nil))
+	found := -1
+	for _, block := range candidates {
+		if remoteSums[block].strong != strong {
+			continue
+		}
+		if int64(block) * DELTA_BLOCK_SIZE == offset {
+			return block, true
+		}
+		if found < 0 {
+			found = block
+		}
+	}
+	return found, found >= 0
+}
+
+// remoteBlockSums computes checksums of each block of the remote file inside the container in one pass,
+// when it's not possible remote file is read through sftp.
+func (f ContainerFilerSftp) remoteBlockSums(remotePath string, size int64) ([]blockSum, error) {
+	nbBlocks := int((size + DELTA_BLOCK_SIZE - 1) / DELTA_BLOCK_SIZE)
+	sums, err := f.execBlockSums(remotePath, nbBlocks)
+	if err == nil && len(sums) == nbBlocks {
+		return sums, nil
+	}
+	if err != nil {
+		logger.Debug("Checksums of '%s' can't be computed in container, reading it: %s", TruncatePath(remotePath), err.Error())
+	}
+	remoteFile, err := f.client.Open(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	defer remoteFile.Close()
+	sums = make([]blockSum, 0, nbBlocks)
+	buf := make([]byte, DELTA_BLOCK_SIZE)
+	for {
+		n, err := io.ReadFull(remoteFile, buf)
+		if n > 0 {
+			sums = append(sums, newBlockSum(buf[:n]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sums, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// execBlockSums runs split once inside the container, each block is given to md5sum and cksum.
+func (f ContainerFilerSftp) execBlockSums(remotePath string, nbBlocks int) ([]blockSum, error) {
+	if f.secureClient == nil {
+		return nil, fmt.Errorf("No ssh client to compute checksums.")
+	}
+	session, err := f.secureClient.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = session.Start(fmt.Sprintf(`d=$(mktemp -d) || exit 1; ` +
+		`split -b %d -a 8 --filter='tee "$FILE" | md5sum && cksum < "$FILE" && rm -f "$FILE"' %s "$d/b"; ` +
+		`status=$?; rm -rf "$d"; exit $status`, DELTA_BLOCK_SIZE, ShellQuote(remotePath)))
+	if err != nil {
+		return nil, err
+	}
+	sums := make([]blockSum, 0, nbBlocks)
+	scanner := bufio.NewScanner(stdout)
+	strong := ""
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		// md5sum gives "<md5> -" and cksum gives "<crc> <size>" for each block
+		if fields[1] == "-" {
+			strong = fields[0]
+			continue
+		}
+		weak, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || strong == "" {
+			return nil, fmt.Errorf("Unexpected checksum output '%s'.", scanner.Text())
+		}
+		sums = append(sums, blockSum{
+			weak: uint32(weak),
+			strong: strong,
+			full: fields[1] == strconv.Itoa(DELTA_BLOCK_SIZE),
+		})
+		strong = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sums, session.Wait()
+}
+
+func newBlockSum(block []byte) blockSum {
+	sum := md5.Sum(block)
+	return blockSum{
+		weak: finishCksum(updateCksum(0, block), int64(len(block))),
+		strong: hex.EncodeToString(sum[:]),
+		full: len(block) == DELTA_BLOCK_SIZE,
+	}
+}
+
+func makeCksumTable() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc & 0x80000000 != 0 {
+				crc = crc << 1 ^ CKSUM_POLY
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}
+
+// makeCksumOutTable gives the crc of each byte followed by DELTA_BLOCK_SIZE zeros, crc being linear it's computed
+// from the crc of each bit.
+func makeCksumOutTable() [256]uint32 {
+	var bits [8]uint32
+	zeros := make([]byte, DELTA_BLOCK_SIZE)
+	for i := range bits {
+		bits[i] = updateCksum(updateCksum(0, []byte{1 << uint(i)}), zeros)
+	}
+	var table [256]uint32
+	for b := range table {
+		for i := range bits {
+			if b & (1 << uint(i)) != 0 {
+				table[b] ^= bits[i]
+			}
+		}
+	}
+	return table
+}
+func updateCksum(crc uint32, data []byte) uint32 {
+	for _, b := range data {
+		crc = crc << 8 ^ cksumTable[byte(crc >> 24) ^ b]
+	}
+	return crc
+}
+
+// rollCksum moves the window of crc by one byte: out leaves the window and in enters it.
+func rollCksum(crc uint32, out, in byte) uint32 {
+	return crc << 8 ^ cksumTable[byte(crc >> 24) ^ in] ^ cksumOutTable[out]
+}
+
+// finishCksum gives the value printed by cksum command for data of length bytes which crc has been updated with.
+func finishCksum(crc uint32, length int64) uint32 {
+	for ; length > 0; length >>= 8 {
+		crc = crc << 8 ^ cksumTable[byte(crc >> 24) ^ byte(length)]
+	}
+	return ^crc
+}
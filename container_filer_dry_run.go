@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ContainerFilerDryRun only prints what would be done by a ContainerFiler, calls which don't change anything
+// in container or in source folder are forwarded to the real ContainerFiler.
+type ContainerFilerDryRun struct {
+	containerFiler ContainerFiler
+}
+
+func NewContainerFilerDryRun(containerFiler ContainerFiler) *ContainerFilerDryRun {
+	return &ContainerFilerDryRun{
+		containerFiler: containerFiler,
+	}
+}
+func (f ContainerFilerDryRun) CopyRemoteFolder(sourceDir, targetDir string) error {
+	files, err := f.containerFiler.ListRemoteFiles(targetDir)
+	if err != nil {
+		return err
+	}
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return f.DownloadFiles(sourceDir, targetDir, paths)
+}
+func (f ContainerFilerDryRun) CopyContent(reader io.Reader, length int64, remotePath string, permissions os.FileMode, modTime time.Time) error {
+	logger.Info("[dry-run] Would upload %d bytes to '%s' with permissions %s.", length, TruncatePath(remotePath), permissions.String())
+	return nil
+}
+func (f ContainerFilerDryRun) CreateFolders(remotePath, dir string) error {
+	logger.Info("[dry-run] Would create folder(s) '%s' in '%s'.", dir, remotePath)
+	return nil
+}
+func (f ContainerFilerDryRun) MakeDir(remotePath string, permissions os.FileMode) error {
+	logger.Info("[dry-run] Would create folder '%s' with permissions %s.", TruncatePath(remotePath), permissions.Perm().String())
+	return nil
+}
+func (f ContainerFilerDryRun) Delete(remotePath string) error {
+	logger.Info("[dry-run] Would delete remote path '%s'.", remotePath)
+	return nil
+}
+func (f ContainerFilerDryRun) Rename(srcRmtPath, trtRmtPath string) error {
+	logger.Info("[dry-run] Would move remote path '%s' to '%s'.", srcRmtPath, trtRmtPath)
+	return nil
+}
+func (f ContainerFilerDryRun) ListRemoteFiles(targetDir string) (map[string]os.FileInfo, error) {
+	return f.containerFiler.ListRemoteFiles(targetDir)
+}
+func (f ContainerFilerDryRun) Download(remotePath, localPath string) error {
+	exists, err := FileExists(localPath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		logger.Info("[dry-run] Would download '%s' and overwrite '%s'.", TruncatePath(remotePath), filepath.FromSlash(TruncatePath(localPath)))
+		return nil
+	}
+	logger.Info("[dry-run] Would download '%s' to '%s'.", TruncatePath(remotePath), filepath.FromSlash(TruncatePath(localPath)))
+	return nil
+}
+func (f ContainerFilerDryRun) DownloadFiles(sourceDir, targetDir string, paths []string) error {
+	for _, path := range paths {
+		err := f.Download(strings.TrimSuffix(targetDir, "/") + "/" + path, filepath.Join(sourceDir, filepath.FromSlash(path)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (f ContainerFilerDryRun) UploadFiles(sourceDir, targetDir string, paths []string) error {
+	for _, path := range paths {
+		logger.Info("[dry-run] Would upload '%s' to '%s'.",
+			filepath.FromSlash(TruncatePath(filepath.Join(sourceDir, path))),
+			TruncatePath(strings.TrimSuffix(targetDir, "/") + "/" + path))
+	}
+	return nil
+}
+func (f ContainerFilerDryRun) Hash(remotePath string) (string, error) {
+	return f.containerFiler.Hash(remotePath)
+}
+func (f ContainerFilerDryRun) Stat(remotePath string) (os.FileInfo, error) {
+	return f.containerFiler.Stat(remotePath)
+}
+func (f ContainerFilerDryRun) Symlink(target, remotePath string) error {
+	logger.Info("[dry-run] Would create symlink '%s' to '%s'.", TruncatePath(remotePath), target)
+	return nil
+}
+func (f ContainerFilerDryRun) ReadLink(remotePath string) (string, error) {
+	return f.containerFiler.ReadLink(remotePath)
+}
+func (f *ContainerFilerDryRun) SetWriter(writer io.Writer) {
+	f.containerFiler.SetWriter(writer)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContainerFilerMulti applies every change to the ContainerFiler of each instance of an app,
+// calls which only read are made on the ready instance with the lowest index.
+type ContainerFilerMulti struct {
+	instances map[int]ContainerFiler
+	joining   map[int]bool
+	writer    io.Writer
+	mutex     *sync.RWMutex
+}
+
+func NewContainerFilerMulti() *ContainerFilerMulti {
+	return &ContainerFilerMulti{
+		instances: make(map[int]ContainerFiler),
+		joining: make(map[int]bool),
+		mutex: &sync.RWMutex{},
+	}
+}
+
+// AddInstance starts sending changes to an instance, it's not read until SetReady is called
+// to let it be synchronized first.
+func (f *ContainerFilerMulti) AddInstance(index int, containerFiler ContainerFiler) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.writer != nil {
+		containerFiler.SetWriter(f.writer)
+	}
+	f.instances[index] = containerFiler
+	f.joining[index] = true
+}
+func (f *ContainerFilerMulti) SetReady(index int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.joining, index)
+}
+func (f *ContainerFilerMulti) RemoveInstance(index int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.instances, index)
+	delete(f.joining, index)
+}
+func (f *ContainerFilerMulti) indexes() []int {
+	indexes := make([]int, 0, len(f.instances))
+	for index := range f.instances {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+func (f *ContainerFilerMulti) primary() (ContainerFiler, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	for _, index := range f.indexes() {
+		if !f.joining[index] {
+			return f.instances[index], nil
+		}
+	}
+	return nil, errors.New("No running instance to read from.")
+}
+
+// each runs operation on every instance in parallel and reports instances where it has failed.
+func (f *ContainerFilerMulti) each(operation func(index int, containerFiler ContainerFiler) error) error {
+	f.mutex.RLock()
+	indexes := f.indexes()
+	instances := make(map[int]ContainerFiler)
+	for _, index := range indexes {
+		instances[index] = f.instances[index]
+	}
+	f.mutex.RUnlock()
+	if len(indexes) == 0 {
+		return errors.New("No running instance to send changes to.")
+	}
+	errs := make([]error, len(indexes))
+	wg := &sync.WaitGroup{}
+	for i, index := range indexes {
+		wg.Add(1)
+		go func(i, index int) {
+			defer wg.Done()
+			errs[i] = operation(index, instances[index])
+		}(i, index)
+	}
+	wg.Wait()
+	succeeded := make([]string, 0)
+	failed := make([]string, 0)
+	for i, index := range indexes {
+		if errs[i] == nil {
+			succeeded = append(succeeded, fmt.Sprintf("#%d", index))
+			continue
+		}
+		logger.Error("Instance #%d: %s", index, errs[i].Error())
+		failed = append(failed, fmt.Sprintf("#%d", index))
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	if len(succeeded) > 0 {
+		logger.Warning("Change applied on instance(s) %s only.", strings.Join(succeeded, ", "))
+	}
+	return fmt.Errorf("Change has failed on instance(s) %s.", strings.Join(failed, ", "))
+}
+func (f *ContainerFilerMulti) CopyRemoteFolder(sourceDir, targetDir string) error {
+	containerFiler, err := f.primary()
+	if err != nil {
+		return err
+	}
+	return containerFiler.CopyRemoteFolder(sourceDir, targetDir)
+}
+func (f *ContainerFilerMulti) CopyContent(reader io.Reader, length int64, remotePath string, permissions os.FileMode, modTime time.Time) error {
+	// each instance needs its own reader on the content
+	readerAt, ok := reader.(io.ReaderAt)
+	if !ok {
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		readerAt = bytes.NewReader(content)
+	}
+	return f.each(func(index int, containerFiler ContainerFiler) error {
+		return containerFiler.CopyContent(io.NewSectionReader(readerAt, 0, length), length, remotePath, permissions, modTime)
+	})
+}
+func (f *ContainerFilerMulti) CreateFolders(remotePath, dir string) error {
+	return f.each(func(index int, containerFiler ContainerFiler) error {
+		return containerFiler.CreateFolders(remotePath, dir)
+	})
+}
+func (f *ContainerFilerMulti) MakeDir(remotePath string, permissions os.FileMode) error {
+	return f.each(func(index int, containerFiler ContainerFiler) error {
+		return containerFiler.MakeDir(remotePath, permissions)
+	})
+}
+func (f *ContainerFilerMulti) Delete(remotePath string) error {
+	return f.each(func(index int, containerFiler ContainerFiler) error {
+		return containerFiler.Delete(remotePath)
+	})
+}
+func (f *ContainerFilerMulti) Rename(srcRmtPath, trtRmtPath string) error {
+	return f.each(func(index int, containerFiler ContainerFiler) error {
+		return containerFiler.Rename(srcRmtPath, trtRmtPath)
+	})
+}
+func (f *ContainerFilerMulti) ListRemoteFiles(targetDir string) (map[string]os.FileInfo, error) {
+	containerFiler, err := f.primary()
+	if err != nil {
+		return nil, err
+	}
+	return containerFiler.ListRemoteFiles(targetDir)
+}
+func (f *ContainerFilerMulti) Download(remotePath, localPath string) error {
+	containerFiler, err := f.primary()
+	if err != nil {
+		return err
+	}
+	return containerFiler.Download(remotePath, localPath)
+}
+func (f *ContainerFilerMulti) DownloadFiles(sourceDir, targetDir string, paths []string) error {
+	containerFiler, err := f.primary()
+	if err != nil {
+		return err
+	}
+	return containerFiler.DownloadFiles(sourceDir, targetDir, paths)
+}
+func (f *ContainerFilerMulti) UploadFiles(sourceDir, targetDir string, paths []string) error {
+	return f.each(func(index int, containerFiler ContainerFiler) error {
+		return containerFiler.UploadFiles(sourceDir, targetDir, paths)
+	})
+}
+func (f *ContainerFilerMulti) Hash(remotePath string) (string, error) {
+	containerFiler, err := f.primary()
+	if err != nil {
+		return "", err
+	}
+	return containerFiler.Hash(remotePath)
+}
+func (f *ContainerFilerMulti) Stat(remotePath string) (os.FileInfo, error) {
+	containerFiler, err := f.primary()
+	if err != nil {
+		return nil, err
+	}
+	return containerFiler.Stat(remotePath)
+}
+func (f *ContainerFilerMulti) Symlink(target, remotePath string) error {
+	return f.each(func(index int, containerFiler ContainerFiler) error {
+		return containerFiler.Symlink(target, remotePath)
+	})
+}
+func (f *ContainerFilerMulti) ReadLink(remotePath string) (string, error) {
+	containerFiler, err := f.primary()
+	if err != nil {
+		return "", err
+	}
+	return containerFiler.ReadLink(remotePath)
+}
+func (f *ContainerFilerMulti) SetWriter(writer io.Writer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.writer = writer
+	for _, containerFiler := range f.instances {
+		containerFiler.SetWriter(writer)
+	}
+}
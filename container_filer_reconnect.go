@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// RECONNECT_MAX_REPLAYS is the number of times an operation is replayed after reconnections before giving up.
+const RECONNECT_MAX_REPLAYS = 3
+
+// ContainerFilerReconnect replays operations of a ContainerFilerSftp which failed because of a broken connection,
+// once the supervisor has reconnected to the container.
+type ContainerFilerReconnect struct {
+	containerFiler *ContainerFilerSftp
+	supervisor     *ConnectionSupervisor
+	mutex          *sync.Mutex
+}
+
+func NewContainerFilerReconnect(containerFiler *ContainerFilerSftp, supervisor *ConnectionSupervisor) *ContainerFilerReconnect {
+	return &ContainerFilerReconnect{
+		containerFiler: containerFiler,
+		supervisor: supervisor,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// current gives the filer using the current connection, it's rebuilt after a reconnection.
+func (f *ContainerFilerReconnect) current() (*ContainerFilerSftp, error) {
+	client := f.supervisor.Client()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.containerFiler.secureClient == client {
+		return f.containerFiler, nil
+	}
+	containerFiler, err := f.containerFiler.withClient(client)
+	if err != nil {
+		return nil, err
+	}
+	f.containerFiler = containerFiler
+	return containerFiler, nil
+}
+func (f *ContainerFilerReconnect) replay(operation func(containerFiler *ContainerFilerSftp) error) error {
+	var err error
+	for i := 0; i <= RECONNECT_MAX_REPLAYS; i++ {
+		var containerFiler *ContainerFilerSftp
+		containerFiler, err = f.current()
+		if err == nil {
+			err = operation(containerFiler)
+		}
+		if err == nil || (containerFiler != nil && !f.supervisor.IsBroken(containerFiler.secureClient, err)) {
+			return err
+		}
+		logger.Warning("Operation has failed because connection to container is broken, it will be replayed: %s", err.Error())
+		brokenClient := f.supervisor.Client()
+		if containerFiler != nil {
+			brokenClient = containerFiler.secureClient
+		}
+		reconnectErr := f.supervisor.Reconnect(brokenClient)
+		if reconnectErr != nil {
+			return reconnectErr
+		}
+	}
+	return err
+}
+func (f *ContainerFilerReconnect) CopyRemoteFolder(sourceDir, targetDir string) error {
+	return f.replay(func(containerFiler *ContainerFilerSftp) error {
+		return containerFiler.CopyRemoteFolder(sourceDir, targetDir)
+	})
+}
+func (f *ContainerFilerReconnect) CopyContent(reader io.Reader, length int64, remotePath string, permissions os.FileMode, modTime time.Time) error {
+	replayed := false
+	return f.replay(func(containerFiler *ContainerFilerSftp) error {
+		if replayed {
+			seeker, ok := reader.(io.Seeker)
+			if !ok {
+				return errors.New("Content can't be sent again, it must be uploaded again manually.")
+			}
+			_, err := seeker.Seek(0, io.SeekStart)
+			if err != nil {
+				return err
+			}
+		}
+		replayed = true
+		return containerFiler.CopyContent(reader, length, remotePath, permissions, modTime)
+	})
+}
+func (f *ContainerFilerReconnect) CreateFolders(remotePath, dir string) error {
+	return f.replay(func(containerFiler *ContainerFilerSftp) error {
+		return containerFiler.CreateFolders(remotePath, dir)
+	})
+}
+func (f *ContainerFilerReconnect) MakeDir(remotePath string, permissions os.FileMode) error {
+	return f.replay(func(containerFiler *ContainerFilerSftp) error {
+		return containerFiler.MakeDir(remotePath, permissions)
+	})
+}
+func (f *ContainerFilerReconnect) Delete(remotePath string) error {
+	return f.replay(func(containerFiler *ContainerFilerSftp) error {
+		return containerFiler.Delete(remotePath)
+	})
+}
+func (f *ContainerFilerReconnect) Rename(srcRmtPath, trtRmtPath string) error {
+	return f.replay(func(containerFiler *ContainerFilerSftp) error {
+		return containerFiler.Rename(srcRmtPath, trtRmtPath)
+	})
+}
+func (f *ContainerFilerReconnect) ListRemoteFiles(targetDir string) (map[string]os.FileInfo, error) {
+	var files map[string]os.FileInfo
+	err := f.replay(func(containerFiler *ContainerFilerSftp) error {
+		var err error
+		files, err = containerFiler.ListRemoteFiles(targetDir)
+		return err
+	})
+	return files, err
+}
+func (f *ContainerFilerReconnect) Download(remotePath, localPath string) error {
+	return f.replay(func(containerFiler *ContainerFilerSftp) error {
+		return containerFiler.Download(remotePath, localPath)
+	})
+}
+func (f *ContainerFilerReconnect) DownloadFiles(sourceDir, targetDir string, paths []string) error {
+	return f.replay(func(containerFiler *ContainerFilerSftp) error {
+		return containerFiler.DownloadFiles(sourceDir, targetDir, paths)
+	})
+}
+func (f *ContainerFilerReconnect) UploadFiles(sourceDir, targetDir string, paths []string) error {
+	return f.replay(func(containerFiler *ContainerFilerSftp) error {
+		return containerFiler.UploadFiles(sourceDir, targetDir, paths)
+	})
+}
+func (f *ContainerFilerReconnect) Hash(remotePath string) (string, error) {
+	var hash string
+	err := f.replay(func(containerFiler *ContainerFilerSftp) error {
+		var err error
+		hash, err = containerFiler.Hash(remotePath)
+		return err
+	})
+	return hash, err
+}
+func (f *ContainerFilerReconnect) Stat(remotePath string) (os.FileInfo, error) {
+	var stat os.FileInfo
+	err := f.replay(func(containerFiler *ContainerFilerSftp) error {
+		var err error
+		stat, err = containerFiler.Stat(remotePath)
+		return err
+	})
+	return stat, err
+}
+func (f *ContainerFilerReconnect) Symlink(target, remotePath string) error {
+	return f.replay(func(containerFiler *ContainerFilerSftp) error {
+		return containerFiler.Symlink(target, remotePath)
+	})
+}
+func (f *ContainerFilerReconnect) ReadLink(remotePath string) (string, error) {
+	var target string
+	err := f.replay(func(containerFiler *ContainerFilerSftp) error {
+		var err error
+		target, err = containerFiler.ReadLink(remotePath)
+		return err
+	})
+	return target, err
+}
+func (f *ContainerFilerReconnect) SetWriter(writer io.Writer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.containerFiler.SetWriter(writer)
+}
@@ -9,61 +9,117 @@ import (
 	"github.com/cheggaaa/pb"
 	"path"
 	"fmt"
+	"time"
 )
 
 type ContainerFilerSftp struct {
-	client     *sftp.Client
-	writer     io.Writer
-	syncIgnore *SyncIgnore
+	client       *sftp.Client
+	secureClient *SecureClient
+	writer       io.Writer
+	syncIgnore   *SyncIgnore
+	delta        bool
+	bulk         bool
+	compress     bool
+	symlinks     string
+	umask        os.FileMode
+	maxDelete    int
 }
 
-func NewContainerFiler(client *SecureClient, syncIgnore *SyncIgnore) (ContainerFiler, error) {
+func NewContainerFiler(client *SecureClient, syncIgnore *SyncIgnore) (*ContainerFilerSftp, error) {
 	sftpClient, err := sftp.NewClient(client.Client())
 	if err != nil {
 		return nil, err
 	}
 	return &ContainerFilerSftp{
 		client: sftpClient,
+		secureClient: client,
 		syncIgnore: syncIgnore,
 	}, nil
 }
+
+// withClient gives a copy of the filer, with the same options, which uses a new ssh connection.
+func (f ContainerFilerSftp) withClient(client *SecureClient) (*ContainerFilerSftp, error) {
+	sftpClient, err := sftp.NewClient(client.Client())
+	if err != nil {
+		return nil, err
+	}
+	f.client.Close()
+	f.client = sftpClient
+	f.secureClient = client
+	return &f, nil
+}
+
+// withSyncIgnore gives a copy of the filer, using the same connection, which applies other ignore rules.
+func (f ContainerFilerSftp) withSyncIgnore(syncIgnore *SyncIgnore) *ContainerFilerSftp {
+	f.syncIgnore = syncIgnore
+	return &f
+}
 func (f ContainerFilerSftp) CopyRemoteFolder(sourceDir, targetDir string) error {
 	targetDir = strings.TrimSuffix(targetDir, "/")
-	walker := f.client.Walk(targetDir)
-	for walker.Step() {
-		if walker.Path() == targetDir {
-			continue
+	if f.bulk {
+		err := f.copyRemoteFolderTar(sourceDir, targetDir)
+		if err == nil {
+			return nil
 		}
-		matchIgnore := f.syncIgnore.Match(walker.Path(), walker.Stat().IsDir())
-		if  matchIgnore && walker.Stat().IsDir(){
-			walker.SkipDir()
-			continue
-		}
-		if matchIgnore {
-			continue
+		logger.Warning("Bulk download has failed, downloading files one by one: %s", err.Error())
+	}
+	dirs := make([]string, 0)
+	dirStats := make(map[string]os.FileInfo)
+	var filesError *FilesError
+	err := f.walk(targetDir, func(remotePath string, stat os.FileInfo) error {
+		if f.syncIgnore.Match(remotePath, stat.IsDir()) {
+			if stat.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
-		if walker.Stat().IsDir() {
-			continue
+		if stat.IsDir() {
+			// folders are created even when empty, their permissions are set once their content is written
+			localPath := f.toLocalPath(sourceDir, targetDir, remotePath)
+			err := os.MkdirAll(localPath, 0755)
+			if err != nil {
+				logger.Error(err.Error())
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, localPath)
+			dirStats[localPath] = stat
+			return nil
 		}
-		if err := walker.Err(); err != nil {
-			logger.Error(err.Error())
-			continue
+		if isTempFile(remotePath) {
+			return nil
 		}
-		err := f.downloadFile(sourceDir, targetDir, walker.Path())
+		err := f.downloadFile(sourceDir, targetDir, remotePath)
 		if err != nil {
 			logger.Error(err.Error())
+			filesError = addFileError(filesError, strings.TrimPrefix(remotePath, targetDir + "/"), err)
 		}
+		return nil
+	})
+	f.setLocalDirsAttributes(dirs, dirStats)
+	if err != nil {
+		return err
+	}
+	if filesError != nil {
+		return filesError
 	}
 	return nil
 }
 func (f *ContainerFilerSftp) downloadFile(sourceDir, targetDir, pathfile string) error {
-	localPath := f.toLocalPath(sourceDir, targetDir, pathfile)
-	directory := path.Dir(localPath)
+	return f.Download(pathfile, f.toLocalPath(sourceDir, targetDir, pathfile))
+}
+func (f ContainerFilerSftp) Download(remotePath, localPath string) error {
+	directory := filepath.Dir(localPath)
+	if f.symlinks == SYMLINKS_PRESERVE {
+		stat, err := f.client.Lstat(remotePath)
+		if err == nil && isSymlink(stat) {
+			return f.downloadSymlink(remotePath, localPath)
+		}
+	}
 	err := os.MkdirAll(directory, 0755)
 	if err != nil {
 		return err
 	}
-	stat, err := f.client.Stat(pathfile)
+	stat, err := f.client.Stat(remotePath)
 	if err != nil {
 		return err
 	}
@@ -74,7 +130,7 @@ func (f *ContainerFilerSftp) downloadFile(sourceDir, targetDir, pathfile string)
 	defer localFile.Close()
 
 	var remoteFile io.Reader
-	remoteFile, err = f.client.Open(pathfile)
+	remoteFile, err = f.client.Open(remotePath)
 	if err != nil {
 		return err
 	}
@@ -82,7 +138,7 @@ func (f *ContainerFilerSftp) downloadFile(sourceDir, targetDir, pathfile string)
 		bar := pb.New64(stat.Size()).SetUnits(pb.U_BYTES)
 		bar.Output = f.writer
 		bar.Prefix(fmt.Sprintf("Downloading file '%s' to '%s'...",
-			TruncatePath(pathfile),
+			TruncatePath(remotePath),
 			filepath.FromSlash(TruncatePath(localPath))))
 		bar.Start()
 		remoteFile = bar.NewProxyReader(remoteFile)
@@ -91,11 +147,127 @@ func (f *ContainerFilerSftp) downloadFile(sourceDir, targetDir, pathfile string)
 	if err != nil {
 		return err
 	}
+	localFile.Close()
+	err = f.setLocalAttributes(localPath, stat.Mode(), stat.ModTime())
+	if err != nil {
+		return err
+	}
 	logger.Info(fmt.Sprintf("File '%s' downloaded to '%s'",
-		TruncatePath(pathfile),
+		TruncatePath(remotePath),
 		filepath.FromSlash(TruncatePath(localPath))))
 	return nil
 }
+func (f ContainerFilerSftp) DownloadFiles(sourceDir, targetDir string, paths []string) error {
+	if f.bulk && len(paths) > 1 {
+		err := f.downloadTar(sourceDir, targetDir, paths)
+		if err == nil {
+			return nil
+		}
+		logger.Warning("Bulk download has failed, downloading files one by one: %s", err.Error())
+	}
+	var filesError *FilesError
+	for _, path := range paths {
+		remotePath := strings.TrimSuffix(targetDir, "/") + "/" + path
+		err := f.Download(remotePath, f.toLocalPath(sourceDir, targetDir, remotePath))
+		if err != nil {
+			logger.Error(err.Error())
+			filesError = addFileError(filesError, path, err)
+		}
+	}
+	if filesError != nil {
+		return filesError
+	}
+	return nil
+}
+func (f ContainerFilerSftp) UploadFiles(sourceDir, targetDir string, paths []string) error {
+	if f.bulk && len(paths) > 1 {
+		err := f.uploadTar(sourceDir, targetDir, paths)
+		if err == nil {
+			return nil
+		}
+		logger.Warning("Bulk upload has failed, uploading files one by one: %s", err.Error())
+	}
+	var filesError *FilesError
+	for _, path := range paths {
+		err := f.uploadFile(filepath.Join(sourceDir, filepath.FromSlash(path)), strings.TrimSuffix(targetDir, "/") + "/" + path)
+		if err != nil {
+			logger.Error(err.Error())
+			filesError = addFileError(filesError, path, err)
+		}
+	}
+	if filesError != nil {
+		return filesError
+	}
+	return nil
+}
+
+// addFileError records the failure of path in filesError, which is created on first failure.
+func addFileError(filesError *FilesError, path string, err error) *FilesError {
+	if filesError == nil {
+		filesError = &FilesError{}
+	}
+	filesError.Paths = append(filesError.Paths, path)
+	filesError.Err = err
+	return filesError
+}
+func (f ContainerFilerSftp) uploadFile(localPath, remotePath string) error {
+	if f.symlinks == SYMLINKS_PRESERVE {
+		stat, err := os.Lstat(localPath)
+		if err == nil && isSymlink(stat) {
+			target, err := os.Readlink(localPath)
+			if err != nil {
+				return err
+			}
+			return f.Symlink(filepath.ToSlash(target), remotePath)
+		}
+	}
+	localFile, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer localFile.Close()
+	stat, err := localFile.Stat()
+	if err != nil {
+		return err
+	}
+	err = f.client.MkdirAll(path.Dir(remotePath))
+	if err != nil {
+		return err
+	}
+	return f.CopyContent(localFile, stat.Size(), remotePath, stat.Mode(), stat.ModTime())
+}
+func (f ContainerFilerSftp) ListRemoteFiles(targetDir string) (map[string]os.FileInfo, error) {
+	targetDir = strings.TrimSuffix(targetDir, "/")
+	files := make(map[string]os.FileInfo)
+	err := f.walk(targetDir, func(remotePath string, stat os.FileInfo) error {
+		if f.syncIgnore.Match(remotePath, stat.IsDir()) {
+			if stat.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if stat.IsDir() || isTempFile(remotePath) {
+			return nil
+		}
+		files[strings.TrimPrefix(remotePath, targetDir + "/")] = stat
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+func (f ContainerFilerSftp) Stat(remotePath string) (os.FileInfo, error) {
+	return f.client.Stat(remotePath)
+}
+func (f ContainerFilerSftp) Hash(remotePath string) (string, error) {
+	remoteFile, err := f.client.Open(remotePath)
+	if err != nil {
+		return "", err
+	}
+	defer remoteFile.Close()
+	return HashContent(remoteFile)
+}
 func (f ContainerFilerSftp) toLocalPath(sourceDir, targetDir, pathfile string) string {
 	if !strings.HasSuffix(sourceDir, string(os.PathSeparator)) {
 		sourceDir += string(os.PathSeparator)
@@ -106,7 +278,16 @@ func (f ContainerFilerSftp) toLocalPath(sourceDir, targetDir, pathfile string) s
 	pathfile = strings.TrimPrefix(pathfile, targetDir)
 	return sourceDir + filepath.FromSlash(pathfile)
 }
-func (f ContainerFilerSftp) CopyContent(reader io.Reader, length int64, remotePath string, permissions os.FileMode) error {
+func (f ContainerFilerSftp) CopyContent(reader io.Reader, length int64, remotePath string, permissions os.FileMode, modTime time.Time) error {
+	if readerAt, ok := reader.(io.ReaderAt); ok && f.delta {
+		done, err := f.copyContentDelta(readerAt, length, remotePath, permissions, modTime)
+		if err != nil {
+			logger.Warning("Delta upload of file '%s' has failed, sending whole file: %s", TruncatePath(remotePath), err.Error())
+		}
+		if done && err == nil {
+			return nil
+		}
+	}
 	if f.writer != nil {
 		bar := pb.New64(length).SetUnits(pb.U_BYTES)
 		bar.Output = f.writer
@@ -114,16 +295,22 @@ func (f ContainerFilerSftp) CopyContent(reader io.Reader, length int64, remotePa
 		bar.Start()
 		reader = bar.NewProxyReader(reader)
 	}
-	remoteFile, err := f.client.Create(remotePath)
+	// content is written in a temporary file to never let the app read a half-written file
+	tempPath := tempPathFor(remotePath)
+	remoteFile, err := f.client.Create(tempPath)
 	if err != nil {
 		return err
 	}
-	defer remoteFile.Close()
 	_, err = io.Copy(remoteFile, reader)
+	remoteFile.Close()
+	if err == nil {
+		err = f.setRemoteAttributes(tempPath, permissions, modTime)
+	}
 	if err != nil {
+		f.client.Remove(tempPath)
 		return err
 	}
-	return f.client.Chmod(remotePath, permissions)
+	return f.moveInPlace(tempPath, remotePath)
 }
 func (f ContainerFilerSftp) CreateFolders(remotePath, dir string) error {
 	if !strings.HasSuffix(remotePath, "/") {
@@ -147,14 +334,29 @@ func (f ContainerFilerSftp) CreateFolders(remotePath, dir string) error {
 	logger.Info("Finished creating folder(s) '%s' in '%s'.", dir, remotePath)
 	return nil
 }
+
+// MakeDir creates remotePath and its parents, remotePath gets permissions masked by umask.
+func (f ContainerFilerSftp) MakeDir(remotePath string, permissions os.FileMode) error {
+	logger.Info("Creating folder '%s' with permissions %s ...", TruncatePath(remotePath), applyUmask(permissions, f.umask).String())
+	err := f.client.MkdirAll(remotePath)
+	if err != nil {
+		return err
+	}
+	err = f.client.Chmod(remotePath, applyUmask(permissions, f.umask))
+	if err != nil {
+		return err
+	}
+	logger.Info("Finished creating folder '%s'.", TruncatePath(remotePath))
+	return nil
+}
 func (f ContainerFilerSftp) Delete(remotePath string) error {
 	logger.Info("Deleting path '%s' ...", remotePath)
-	stat, err := f.client.Stat(remotePath)
+	stat, err := f.client.Lstat(remotePath)
 	if err != nil {
 		return err
 	}
 	if stat.IsDir() {
-		err = f.client.RemoveDirectory(remotePath)
+		err = f.removeTree(remotePath)
 	} else {
 		err = f.client.Remove(remotePath)
 	}
@@ -175,4 +377,11 @@ func (f ContainerFilerSftp) Rename(srcRmtPath, trtRmtPath string) error {
 }
 func (f *ContainerFilerSftp) SetWriter(writer io.Writer) {
 	f.writer = writer
+}
+func (f *ContainerFilerSftp) SetDelta(delta bool) {
+	f.delta = delta
+}
+func (f *ContainerFilerSftp) SetBulk(bulk, compress bool) {
+	f.bulk = bulk
+	f.compress = compress
 }
\ No newline at end of file
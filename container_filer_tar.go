@@ -0,0 +1,329 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// copyRemoteFolderTar downloads a remote folder as a single tar stream created by tar command inside the container.
+func (f ContainerFilerSftp) copyRemoteFolderTar(sourceDir, targetDir string) error {
+	return f.downloadTar(sourceDir, targetDir, nil)
+}
+
+// downloadTar extracts in sourceDir the tar stream of targetDir created inside the container,
+// if paths is not nil only those paths (relative to targetDir) are put in the stream.
+func (f ContainerFilerSftp) downloadTar(sourceDir, targetDir string, paths []string) error {
+	session, err := f.secureClient.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	stderr := &bytes.Buffer{}
+	session.Stderr = stderr
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	listFile := ". "
+	if paths != nil {
+		listFile = "-T - "
+		session.Stdin = strings.NewReader(strings.Join(paths, "\n") + "\n")
+	}
+	err = session.Start("tar c" + f.tarFollowFlag() + f.tarCompressFlag() + "f - -C " + ShellQuote(targetDir) + " " + listFile)
+	if err != nil {
+		return err
+	}
+	var archive io.Reader = stdout
+	if f.compress {
+		gzipReader, err := gzip.NewReader(stdout)
+		if err != nil {
+			return tarError(err, session.Wait(), stderr)
+		}
+		defer gzipReader.Close()
+		archive = gzipReader
+	}
+	nbFiles, err := f.extractTar(archive, sourceDir, targetDir)
+	if err != nil {
+		return tarError(err, session.Wait(), stderr)
+	}
+	err = session.Wait()
+	if err != nil {
+		return tarError(err, nil, stderr)
+	}
+	logger.Info("%d file(s) downloaded from '%s' to '%s' in bulk.", nbFiles, TruncatePath(targetDir), filepath.FromSlash(TruncatePath(sourceDir)))
+	return nil
+}
+func (f ContainerFilerSftp) extractTar(archive io.Reader, sourceDir, targetDir string) (int, error) {
+	targetDir = strings.TrimSuffix(targetDir, "/")
+	tarReader := tar.NewReader(archive)
+	ignoredDirs := make([]string, 0)
+	dirs := make([]string, 0)
+	dirStats := make(map[string]os.FileInfo)
+	defer func() {
+		f.setLocalDirsAttributes(dirs, dirStats)
+	}()
+	nbFiles := 0
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nbFiles, nil
+		}
+		if err != nil {
+			return nbFiles, err
+		}
+		localPath, err := safeLocalPath(sourceDir, header.Name)
+		if err != nil {
+			logger.Warning("Entry '%s' of tar stream is skipped: %s", header.Name, err.Error())
+			continue
+		}
+		if localPath == "" {
+			continue
+		}
+		name := filepath.ToSlash(strings.TrimPrefix(localPath, filepath.Clean(sourceDir) + string(os.PathSeparator)))
+		remotePath := targetDir + "/" + name
+		isDir := header.Typeflag == tar.TypeDir
+		if isInDirs(remotePath, ignoredDirs) || isTempFile(remotePath) {
+			continue
+		}
+		if f.syncIgnore.Match(remotePath, isDir) {
+			if isDir {
+				ignoredDirs = append(ignoredDirs, remotePath)
+			}
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if isLocalSymlink(localPath) {
+				logger.Warning("Entry '%s' of tar stream is skipped: local path is a symlink.", header.Name)
+				continue
+			}
+			err = os.MkdirAll(localPath, 0755)
+			dirs = append(dirs, localPath)
+			dirStats[localPath] = header.FileInfo()
+		case tar.TypeSymlink:
+			err = os.MkdirAll(filepath.Dir(localPath), 0755)
+			if err == nil {
+				os.Remove(localPath)
+				err = os.Symlink(header.Linkname, localPath)
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			// a file replaces a symlink, it's never written through it
+			if isLocalSymlink(localPath) {
+				os.Remove(localPath)
+			}
+			err = writeLocalFile(localPath, tarReader, header.FileInfo().Mode())
+			if err == nil {
+				err = f.setLocalAttributes(localPath, header.FileInfo().Mode(), header.ModTime)
+			}
+			nbFiles++
+		case tar.TypeLink:
+			// hard links point to a file already extracted from the stream, its content is copied
+			var targetPath string
+			targetPath, err = safeLocalPath(sourceDir, header.Linkname)
+			if err != nil || targetPath == "" {
+				logger.Warning("Entry '%s' of tar stream is skipped: link target '%s' is refused.", header.Name, header.Linkname)
+				continue
+			}
+			if isLocalSymlink(localPath) {
+				os.Remove(localPath)
+			}
+			err = copyLocalFileTo(targetPath, localPath, header.FileInfo().Mode())
+			if err == nil {
+				err = f.setLocalAttributes(localPath, header.FileInfo().Mode(), header.ModTime)
+			}
+			nbFiles++
+		}
+		if err != nil {
+			return nbFiles, err
+		}
+	}
+}
+
+// uploadTar sends paths (relative to sourceDir) as a single tar stream extracted by tar command inside the container.
+// The stream is extracted in a staging folder and each file is then moved in place, so the app never reads a
+// half-written file.
+func (f ContainerFilerSftp) uploadTar(sourceDir, targetDir string, paths []string) error {
+	session, err := f.secureClient.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	stderr := &bytes.Buffer{}
+	session.Stderr = stderr
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	err = session.Start(f.extractInPlaceCommand(targetDir))
+	if err != nil {
+		return err
+	}
+	err = f.writeTar(stdin, sourceDir, paths)
+	stdin.Close()
+	if err != nil {
+		return tarError(err, session.Wait(), stderr)
+	}
+	err = session.Wait()
+	if err != nil {
+		return tarError(err, nil, stderr)
+	}
+	logger.Info("%d file(s) uploaded from '%s' to '%s' in bulk.", len(paths), filepath.FromSlash(TruncatePath(sourceDir)), TruncatePath(targetDir))
+	return nil
+}
+
+// extractInPlaceCommand gives the shell command which extracts a tar stream in a staging folder of targetDir, moves
+// every file in place and removes the staging folder.
+func (f ContainerFilerSftp) extractInPlaceCommand(targetDir string) string {
+	targetDir = strings.TrimSuffix(targetDir, "/")
+	staging := ShellQuote(targetDir + "/" + TEMP_FILE_PREFIX + fmt.Sprintf("%d", time.Now().UnixNano()))
+	target := ShellQuote(targetDir)
+	moveFiles := "find . ! -type d | while IFS= read -r f; do " +
+		"mkdir -p " + target + "/\"${f%/*}\" && mv -f \"$f\" " + target + "/\"$f\" || exit 1; done"
+	extract := "mkdir -p " + staging + " && tar xp" + f.tarCompressFlag() + "f - -C " + staging +
+		" && cd " + staging + " && " + moveFiles
+	return "(" + extract + "); status=$?; rm -rf " + staging + "; exit $status"
+}
+func (f ContainerFilerSftp) writeTar(writer io.Writer, sourceDir string, paths []string) error {
+	if f.compress {
+		gzipWriter := gzip.NewWriter(writer)
+		defer gzipWriter.Close()
+		writer = gzipWriter
+	}
+	tarWriter := tar.NewWriter(writer)
+	for _, path := range paths {
+		localPath := filepath.Join(sourceDir, filepath.FromSlash(path))
+		stat, err := f.localStat(localPath)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if isSymlink(stat) {
+			link, err = os.Readlink(localPath)
+			if err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(stat, link)
+		if err != nil {
+			return err
+		}
+		header.Name = path
+		// permissions are kept by tar with p flag, modification time is always kept
+		header.Mode = int64(applyUmask(stat.Mode(), f.umask))
+		err = tarWriter.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+		if !stat.Mode().IsRegular() {
+			continue
+		}
+		err = copyLocalFile(tarWriter, localPath)
+		if err != nil {
+			return err
+		}
+	}
+	return tarWriter.Close()
+}
+
+// tarFollowFlag makes tar archive files pointed by symlinks instead of symlinks, unless they are preserved.
+func (f ContainerFilerSftp) tarFollowFlag() string {
+	if f.symlinks == SYMLINKS_PRESERVE {
+		return ""
+	}
+	return "h"
+}
+func (f ContainerFilerSftp) tarCompressFlag() string {
+	if f.compress {
+		return "z"
+	}
+	return ""
+}
+
+func writeLocalFile(localPath string, reader io.Reader, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(localPath), 0755)
+	if err != nil {
+		return err
+	}
+	localFile, err := os.OpenFile(localPath, os.O_RDWR | os.O_CREATE | os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer localFile.Close()
+	_, err = io.Copy(localFile, reader)
+	return err
+}
+func copyLocalFileTo(sourcePath, localPath string, mode os.FileMode) error {
+	sourceFile, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+	return writeLocalFile(localPath, sourceFile, mode)
+}
+func copyLocalFile(writer io.Writer, localPath string) error {
+	localFile, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer localFile.Close()
+	_, err = io.Copy(writer, localFile)
+	return err
+}
+
+// safeLocalPath gives the local path of a tar entry, an entry which is absolute, goes out of sourceDir or goes through
+// a symlink inside sourceDir (extracted from the stream or already there) is refused. An empty path is given for the
+// root of the stream.
+func safeLocalPath(sourceDir, name string) (string, error) {
+	if path.IsAbs(name) || filepath.IsAbs(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("absolute path is not allowed.")
+	}
+	root := filepath.Clean(sourceDir)
+	localPath := filepath.Join(root, filepath.FromSlash(name))
+	if localPath == root {
+		return "", nil
+	}
+	if !strings.HasPrefix(localPath, root + string(os.PathSeparator)) {
+		return "", fmt.Errorf("path goes out of '%s'.", TruncatePath(root))
+	}
+	parent := root
+	for _, component := range strings.Split(filepath.Dir(strings.TrimPrefix(localPath, root + string(os.PathSeparator))), string(os.PathSeparator)) {
+		if component == "." {
+			break
+		}
+		parent = filepath.Join(parent, component)
+		if isLocalSymlink(parent) {
+			return "", fmt.Errorf("path goes through symlink '%s'.", TruncatePath(parent))
+		}
+	}
+	return localPath, nil
+}
+func isLocalSymlink(localPath string) bool {
+	stat, err := os.Lstat(localPath)
+	return err == nil && isSymlink(stat)
+}
+func isInDirs(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(path, dir + "/") {
+			return true
+		}
+	}
+	return false
+}
+func tarError(err, waitErr error, stderr *bytes.Buffer) error {
+	msg := strings.TrimSpace(stderr.String())
+	if msg == "" && waitErr != nil {
+		msg = waitErr.Error()
+	}
+	if msg == "" {
+		return err
+	}
+	return fmt.Errorf("%s (tar: %s)", err.Error(), msg)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rjeczalik/notify"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EDITOR_VIM       = "vim"
+	EDITOR_EMACS     = "emacs"
+	EDITOR_JETBRAINS = "jetbrains"
+	// EDITOR_ATOMIC is for editors which write a new file and move it over the saved file (VS Code, Sublime Text...).
+	EDITOR_ATOMIC = "atomic"
+	EDITORS_NONE  = "none"
+	// EDITOR_SAVE_DELAY is the time to wait for the end of a save once an editor has moved the saved file away to
+	// rewrite it, the file is sent when the editor removes its backup or after this delay.
+	EDITOR_SAVE_DELAY = 1 * time.Second
+	// VIM_PROBE_FILE is the first file vim creates to check it can write in a folder, next ones are 123 apart.
+	VIM_PROBE_FILE = 4913
+)
+
+// EditorProfile recognises files an editor writes next to the file it saves: temporary files, backups, locks
+// and probes. They are never synchronized, the saved file is sent once instead.
+type EditorProfile struct {
+	Name string
+	// savedName gives the name of the file saved through the file named name, ok is false when name is not
+	// written by the editor and saved is empty when it's not related to one file.
+	savedName func(name string) (saved string, ok bool)
+}
+
+var editorProfiles []EditorProfile = []EditorProfile{
+	{Name: EDITOR_VIM, savedName: vimSavedName},
+	{Name: EDITOR_EMACS, savedName: emacsSavedName},
+	{Name: EDITOR_JETBRAINS, savedName: jetbrainsSavedName},
+	{Name: EDITOR_ATOMIC},
+}
+
+// vimFiles only match hidden swap files, so that files like movie.swf or lib.swc are still synchronized.
+var vimFiles []*regexp.Regexp = []*regexp.Regexp{
+	regexp.MustCompile(`^\.(.+)\.sw[a-p]$`),
+	regexp.MustCompile(`^\.(.+)\.swx$`),
+	regexp.MustCompile(`^(.+)~$`),
+}
+var emacsFiles []*regexp.Regexp = []*regexp.Regexp{
+	regexp.MustCompile(`^\.#(.+)$`),
+	regexp.MustCompile(`^#(.+)#$`),
+	regexp.MustCompile(`^(.+)\.~\d+~$`),
+	regexp.MustCompile(`^(.+)~$`),
+}
+var jetbrainsFiles []*regexp.Regexp = []*regexp.Regexp{
+	regexp.MustCompile(`^(.+)___jb_(tmp|old|bak)___$`),
+}
+
+func vimSavedName(name string) (string, bool) {
+	probe, err := strconv.Atoi(name)
+	if err == nil && probe >= VIM_PROBE_FILE && (probe - VIM_PROBE_FILE) % 123 == 0 {
+		return "", true
+	}
+	return matchSavedName(name, vimFiles)
+}
+func emacsSavedName(name string) (string, bool) {
+	return matchSavedName(name, emacsFiles)
+}
+func jetbrainsSavedName(name string) (string, bool) {
+	return matchSavedName(name, jetbrainsFiles)
+}
+func matchSavedName(name string, patterns []*regexp.Regexp) (string, bool) {
+	for _, pattern := range patterns {
+		matches := pattern.FindStringSubmatch(name)
+		if matches != nil {
+			return matches[1], true
+		}
+	}
+	return "", false
+}
+
+// ParseEditors gives profiles of the comma separated list of editors, none disables all of them.
+func ParseEditors(value string) ([]EditorProfile, error) {
+	editors := make([]EditorProfile, 0)
+	if value == EDITORS_NONE {
+		return editors, nil
+	}
+	names := make([]string, 0, len(editorProfiles))
+	for _, editor := range editorProfiles {
+		names = append(names, editor.Name)
+	}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, editor := range editorProfiles {
+			if editor.Name == name {
+				editors = append(editors, editor)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Invalid editor '%s', valid editors are: %s (or %s).", name, strings.Join(names, ", "), EDITORS_NONE)
+		}
+	}
+	return editors, nil
+}
+func DefaultEditors() string {
+	names := make([]string, 0, len(editorProfiles))
+	for _, editor := range editorProfiles {
+		names = append(names, editor.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// saveTimeoutEvent is sent when an editor has not finished to save path in time.
+type saveTimeoutEvent struct {
+	path string
+	id   int
+}
+
+func (e saveTimeoutEvent) Event() notify.Event {
+	return notify.Rename
+}
+func (e saveTimeoutEvent) Path() string {
+	return e.path
+}
+func (e saveTimeoutEvent) Sys() interface{} {
+	return nil
+}
+
+// editorFile tells if path is written by an editor while saving a file, savedPath is the saved file when known.
+func (s Sync) editorFile(path string) (savedPath string, ok bool) {
+	name := filepath.Base(path)
+	for _, editor := range s.editors {
+		if editor.savedName == nil {
+			continue
+		}
+		saved, ok := editor.savedName(name)
+		if !ok {
+			continue
+		}
+		if saved == "" {
+			return "", true
+		}
+		return filepath.Join(filepath.Dir(path), saved), true
+	}
+	return "", false
+}
+func (s Sync) hasEditor(name string) bool {
+	for _, editor := range s.editors {
+		if editor.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// editorEvent handles an event on a file written by an editor, such file is never sent but removing a backup
+// finishes the save of the file it was made for.
+func (s *Sync) editorEvent(event notify.EventInfo) (bool, error) {
+	savedPath, ok := s.editorFile(event.Path())
+	if !ok {
+		return false, nil
+	}
+	if event.Event() == notify.Remove && savedPath != "" && s.isSaving(savedPath) {
+		return true, s.finishSave(savedPath, 0)
+	}
+	return true, nil
+}
+
+// editorRename handles a move from or to a file written by an editor: moving the saved file away starts its save
+// and moving a new file over it finishes the save.
+func (s *Sync) editorRename(oldPath, path string) (bool, error) {
+	_, oldIsEditorFile := s.editorFile(oldPath)
+	_, isEditorFile := s.editorFile(path)
+	switch {
+	case oldIsEditorFile && isEditorFile:
+		return true, nil
+	case isEditorFile:
+		s.startSave(oldPath)
+		return true, nil
+	case oldIsEditorFile:
+		if s.isSaving(path) {
+			return true, s.finishSave(path, 0)
+		}
+		return true, s.upload(path, true)
+	}
+	return false, nil
+}
+
+// startSave delays every change on path until the editor has finished to save it.
+func (s *Sync) startSave(path string) {
+	s.savingMutex.Lock()
+	s.savingId++
+	id := s.savingId
+	s.saving[path] = id
+	s.savingMutex.Unlock()
+	logger.Info("File '%s' is being saved by an editor, it will be sent once saved.", TruncatePath(path))
+	go func() {
+		time.Sleep(EDITOR_SAVE_DELAY)
+		s.eventChan <- saveTimeoutEvent{path: path, id: id}
+	}()
+}
+func (s *Sync) isSaving(path string) bool {
+	s.savingMutex.Lock()
+	defer s.savingMutex.Unlock()
+	_, ok := s.saving[path]
+	return ok
+}
+
+// finishSave sends path once its save is finished, id is the save to finish or 0 for the current one.
+func (s *Sync) finishSave(path string, id int) error {
+	s.savingMutex.Lock()
+	current, ok := s.saving[path]
+	if !ok || (id != 0 && id != current) {
+		s.savingMutex.Unlock()
+		return nil
+	}
+	delete(s.saving, path)
+	s.savingMutex.Unlock()
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		logger.Info("File '%s' has not been saved again by the editor.", TruncatePath(path))
+		return s.delete(path)
+	}
+	logger.Info("File '%s' has been saved by an editor, update sent.", TruncatePath(path))
+	return s.upload(path, true)
+}
+
+// replacedByMove tells if a move from oldPath to path is an atomic save: a new file, never sent, is moved
+// over the saved file. A file which exists in the container has been sent and is renamed there instead.
+func (s Sync) replacedByMove(oldPath, path string) bool {
+	if !s.hasEditor(EDITOR_ATOMIC) {
+		return false
+	}
+	if _, ok := s.state.Get(s.TrimPath(oldPath)); ok {
+		return false
+	}
+	stat, err := os.Lstat(path)
+	if err != nil || !stat.Mode().IsRegular() {
+		return false
+	}
+	_, err = s.containerFiler.Stat(s.ToRemotePath(oldPath))
+	return os.IsNotExist(err)
+}
+
+func (s *Sync) SetEditors(editors []EditorProfile) {
+	s.editors = editors
+}
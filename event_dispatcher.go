@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/rjeczalik/notify"
+	"sync"
+)
+
+// EventDispatcher runs events with a pool of workers.
+// An event is never run before or at the same time as an event received before it on the same path,
+// on one of its parents or on one of its children. Rename and move events wait for every event received before them
+// and block every event received after them.
+type EventDispatcher struct {
+	handler func(notify.EventInfo)
+	queue   []notify.EventInfo
+	running []notify.EventInfo
+	mutex   *sync.Mutex
+	cond    *sync.Cond
+}
+
+func NewEventDispatcher(nbWorkers int, handler func(notify.EventInfo)) *EventDispatcher {
+	mutex := &sync.Mutex{}
+	d := &EventDispatcher{
+		handler: handler,
+		queue: make([]notify.EventInfo, 0),
+		running: make([]notify.EventInfo, 0),
+		mutex: mutex,
+		cond: sync.NewCond(mutex),
+	}
+	for i := 0; i < nbWorkers; i++ {
+		go d.work()
+	}
+	return d
+}
+func (d *EventDispatcher) Dispatch(ei notify.EventInfo) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.queue = append(d.queue, ei)
+	d.cond.Broadcast()
+}
+func (d *EventDispatcher) work() {
+	for {
+		d.mutex.Lock()
+		ei := d.next()
+		for ei == nil {
+			d.cond.Wait()
+			ei = d.next()
+		}
+		d.running = append(d.running, ei)
+		d.mutex.Unlock()
+
+		d.handler(ei)
+
+		d.mutex.Lock()
+		for i, runningEvent := range d.running {
+			if runningEvent == ei {
+				d.running = append(d.running[:i], d.running[i + 1:]...)
+				break
+			}
+		}
+		d.cond.Broadcast()
+		d.mutex.Unlock()
+	}
+}
+
+// next removes from queue and returns the first event which can be run, mutex must be held.
+func (d *EventDispatcher) next() notify.EventInfo {
+	for i, ei := range d.queue {
+		if d.canRun(ei, d.running) && d.canRun(ei, d.queue[:i]) {
+			d.queue = append(d.queue[:i], d.queue[i + 1:]...)
+			return ei
+		}
+	}
+	return nil
+}
+func (d *EventDispatcher) canRun(ei notify.EventInfo, before []notify.EventInfo) bool {
+	for _, beforeEvent := range before {
+		if isOrderedEvent(ei, beforeEvent) {
+			return false
+		}
+	}
+	return true
+}
+
+func isOrderedEvent(ei, otherEvent notify.EventInfo) bool {
+	if isBarrierEvent(ei) || isBarrierEvent(otherEvent) {
+		return true
+	}
+	return ei.Path() == otherEvent.Path() || isRelatedPath(ei.Path(), otherEvent.Path())
+}
+func isBarrierEvent(ei notify.EventInfo) bool {
+	_, isRemote := ei.(*RemoteEvent)
+	return !isRemote && (ei.Event() == notify.Rename || isMoveEvent(ei))
+}
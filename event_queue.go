@@ -0,0 +1,200 @@
+package main
+
+import (
+	"github.com/rjeczalik/notify"
+	"os"
+	"strings"
+	"time"
+)
+
+const DEFAULT_DEBOUNCE = 200 * time.Millisecond
+
+// QueuedEvent is the result of several local events coalesced on the same path.
+type QueuedEvent struct {
+	event notify.Event
+	path  string
+	sys   interface{}
+}
+
+func (e QueuedEvent) Event() notify.Event {
+	return e.event
+}
+func (e QueuedEvent) Path() string {
+	return e.path
+}
+func (e QueuedEvent) Sys() interface{} {
+	return e.sys
+}
+
+type pendingEvent struct {
+	event    notify.Event
+	dropped  bool
+	// existed tells if the file existed before the first event, it's false when this event is a create
+	existed  bool
+	sys      interface{}
+	lastSeen time.Time
+}
+
+// EventQueue groups create, write and remove events received on the same path until no event has been received
+// for this path during the quiet window, then it sends only one event for it.
+// Rename events, move events and remote events are not coalesced, they are sent right after pending events on the same path.
+type EventQueue struct {
+	quietWindow time.Duration
+	pending     map[string]*pendingEvent
+	order       []string
+}
+
+func NewEventQueue(quietWindow time.Duration) *EventQueue {
+	return &EventQueue{
+		quietWindow: quietWindow,
+		pending: make(map[string]*pendingEvent),
+		order: make([]string, 0),
+	}
+}
+func (q *EventQueue) Run(in <-chan notify.EventInfo, out chan <- notify.EventInfo) {
+	timer := time.NewTimer(q.quietWindow)
+	for {
+		select {
+		case ei, ok := <-in:
+			if !ok {
+				q.flush(out, time.Time{})
+				close(out)
+				return
+			}
+			q.push(ei, out)
+		case <-timer.C:
+			q.flush(out, time.Now())
+		}
+		timer.Stop()
+		select {
+		case <-timer.C:
+		default:
+		}
+		if len(q.order) > 0 {
+			timer.Reset(q.nextDeadline())
+		}
+	}
+}
+func (q *EventQueue) push(ei notify.EventInfo, out chan <- notify.EventInfo) {
+	path := ei.Path()
+	_, isRemote := ei.(*RemoteEvent)
+	event := ei.Event()
+	if isRemote || isMoveEvent(ei) || (event != notify.Create && event != notify.Write && event != notify.Remove) {
+		q.flushRelated(path, out)
+		out <- ei
+		return
+	}
+	pending, ok := q.pending[path]
+	if !ok {
+		q.pending[path] = &pendingEvent{
+			event: event,
+			existed: event != notify.Create,
+			sys: ei.Sys(),
+			lastSeen: time.Now(),
+		}
+		q.order = append(q.order, path)
+		return
+	}
+	pending.lastSeen = time.Now()
+	pending.sys = ei.Sys()
+	if pending.dropped {
+		pending.dropped = false
+		pending.event = event
+		return
+	}
+	switch {
+	case pending.event == notify.Create && event == notify.Remove && pending.existed:
+		// file has been replaced then deleted, it must still be deleted
+		pending.event = notify.Remove
+	case pending.event == notify.Create && event == notify.Remove:
+		// file has been created then deleted before being sent, nothing has to be done
+		pending.dropped = true
+	case pending.event == notify.Create:
+		// file is still being created
+	case pending.event == notify.Remove && event != notify.Remove:
+		// file has been replaced
+		pending.event = notify.Create
+	case pending.event == notify.Write && event == notify.Create:
+		pending.event = notify.Write
+	default:
+		pending.event = event
+	}
+}
+
+// flush sends every pending event which has not received event since the quiet window before now,
+// a zero now flushes all pending events.
+func (q *EventQueue) flush(out chan <- notify.EventInfo, now time.Time) {
+	for i := 0; i < len(q.order); i++ {
+		path := q.order[i]
+		pending := q.pending[path]
+		if !now.IsZero() && now.Sub(pending.lastSeen) < q.quietWindow {
+			continue
+		}
+		// parents and children queued before must be sent first to keep order between a folder and its content
+		relatedPath := ""
+		for _, orderedPath := range q.order[:i] {
+			if isRelatedPath(path, orderedPath) {
+				relatedPath = orderedPath
+				break
+			}
+		}
+		if relatedPath != "" {
+			q.flushPath(relatedPath, out)
+			i = -1
+			continue
+		}
+		q.flushPath(path, out)
+		i--
+	}
+}
+func (q *EventQueue) flushRelated(path string, out chan <- notify.EventInfo) {
+	related := make([]string, 0)
+	for _, orderedPath := range q.order {
+		if orderedPath == path || isRelatedPath(path, orderedPath) {
+			related = append(related, orderedPath)
+		}
+	}
+	for _, relatedPath := range related {
+		q.flushPath(relatedPath, out)
+	}
+}
+func (q *EventQueue) flushPath(path string, out chan <- notify.EventInfo) {
+	pending, ok := q.pending[path]
+	if !ok {
+		return
+	}
+	delete(q.pending, path)
+	for i, orderedPath := range q.order {
+		if orderedPath == path {
+			q.order = append(q.order[:i], q.order[i + 1:]...)
+			break
+		}
+	}
+	if pending.dropped {
+		logger.Info("Events for file '%s' have been dropped, it was created and deleted.", TruncatePath(path))
+		return
+	}
+	out <- &QueuedEvent{
+		event: pending.event,
+		path: path,
+		sys: pending.sys,
+	}
+}
+func (q *EventQueue) nextDeadline() time.Duration {
+	var oldest time.Time
+	for _, pending := range q.pending {
+		if oldest.IsZero() || pending.lastSeen.Before(oldest) {
+			oldest = pending.lastSeen
+		}
+	}
+	next := q.quietWindow - time.Since(oldest)
+	if next < 0 {
+		return 0
+	}
+	return next
+}
+
+func isRelatedPath(path, otherPath string) bool {
+	sep := string(os.PathSeparator)
+	return strings.HasPrefix(path, otherPath + sep) || strings.HasPrefix(otherPath, path + sep)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ParseUmask parses an octal umask (e.g. 022), permission bits it contains are removed from synchronized files.
+func ParseUmask(value string) (os.FileMode, error) {
+	if value == "" {
+		return 0, nil
+	}
+	umask, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || umask > 0777 {
+		return 0, fmt.Errorf("Invalid umask '%s', it must be an octal value between 000 and 777.", value)
+	}
+	return os.FileMode(umask), nil
+}
+func applyUmask(permissions, umask os.FileMode) os.FileMode {
+	return permissions.Perm() &^ umask
+}
+
+// setRemoteAttributes gives to remotePath the permissions, masked by umask, and the modification time of the source file.
+func (f ContainerFilerSftp) setRemoteAttributes(remotePath string, permissions os.FileMode, modTime time.Time) error {
+	err := f.client.Chmod(remotePath, applyUmask(permissions, f.umask))
+	if err != nil || modTime.IsZero() {
+		return err
+	}
+	return f.client.Chtimes(remotePath, modTime, modTime)
+}
+
+// setLocalAttributes gives to localPath the permissions, masked by umask, and the modification time of the remote file.
+func (f ContainerFilerSftp) setLocalAttributes(localPath string, permissions os.FileMode, modTime time.Time) error {
+	err := os.Chmod(localPath, applyUmask(permissions, f.umask))
+	if err != nil || modTime.IsZero() {
+		return err
+	}
+	return os.Chtimes(localPath, modTime, modTime)
+}
+
+// setLocalDirsAttributes gives to local folders, listed parents first, attributes of remote folders.
+// It must be called once their content is written, writing in a folder changes its modification time.
+func (f ContainerFilerSftp) setLocalDirsAttributes(dirs []string, stats map[string]os.FileInfo) {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		stat := stats[dirs[i]]
+		err := f.setLocalAttributes(dirs[i], stat.Mode(), stat.ModTime())
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}
+}
+func (f *ContainerFilerSftp) SetUmask(umask os.FileMode) {
+	f.umask = umask
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	INSTANCE_POLL_INTERVAL   = 10 * time.Second
+	INSTANCE_START_TOLERANCE = 5 * time.Second
+)
+
+// InstanceConnection is the supervised ssh connection to one instance of the app.
+type InstanceConnection struct {
+	index          int
+	secureShell    *SecureShell
+	supervisor     *ConnectionSupervisor
+	containerFiler *ContainerFilerSftp
+}
+
+// ContainerFiler gives a ContainerFiler using this connection which applies ignore rules of mapping.
+func (c *InstanceConnection) ContainerFiler(mapping Mapping) *ContainerFilerReconnect {
+	return NewContainerFilerReconnect(c.containerFiler.withSyncIgnore(mapping.SyncIgnore), c.supervisor)
+}
+func (c *InstanceConnection) Close() {
+	c.supervisor.Stop()
+	c.secureShell.Close()
+}
+
+type instanceMapping struct {
+	mapping        Mapping
+	containerFiler *ContainerFilerMulti
+	onJoin         func(containerFiler ContainerFiler) error
+}
+
+// InstanceWatcher follows instances of the app which are running, it connects to instances which start
+// and stops sending changes to instances which stop.
+type InstanceWatcher struct {
+	processType string
+	instances   func() (map[int]time.Time, error)
+	connect     func(index int) (*InstanceConnection, error)
+	mappings    []*instanceMapping
+	connections map[int]*InstanceConnection
+	since       map[int]time.Time
+	interval    time.Duration
+	mutex       *sync.Mutex
+	stopCh      chan struct{}
+}
+
+// instances gives the start time of each running instance by index.
+func NewInstanceWatcher(processType string, instances func() (map[int]time.Time, error), connect func(index int) (*InstanceConnection, error)) *InstanceWatcher {
+	return &InstanceWatcher{
+		processType: processType,
+		instances: instances,
+		connect: connect,
+		mappings: make([]*instanceMapping, 0),
+		connections: make(map[int]*InstanceConnection),
+		since: make(map[int]time.Time),
+		interval: INSTANCE_POLL_INTERVAL,
+		mutex: &sync.Mutex{},
+		stopCh: make(chan struct{}),
+	}
+}
+
+// AddMapping gives the ContainerFiler which sends changes of mapping to every connected instance.
+func (w *InstanceWatcher) AddMapping(mapping Mapping) *ContainerFilerMulti {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	containerFiler := NewContainerFilerMulti()
+	w.mappings = append(w.mappings, &instanceMapping{
+		mapping: mapping,
+		containerFiler: containerFiler,
+	})
+	return containerFiler
+}
+
+// Ready must be called when the initial synchronization of the mapping using syncIgnore is finished,
+// onJoin is then used to synchronize instances which join.
+// Other instances are connected once every mapping is ready.
+func (w *InstanceWatcher) Ready(syncIgnore *SyncIgnore, onJoin func(containerFiler ContainerFiler) error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, instanceMapping := range w.mappings {
+		if instanceMapping.mapping.SyncIgnore == syncIgnore {
+			instanceMapping.onJoin = onJoin
+		}
+	}
+}
+
+// ConnectFirst connects to the running instance with the lowest index, which is used to read remote folder.
+func (w *InstanceWatcher) ConnectFirst() (*InstanceConnection, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	running, err := w.instances()
+	if err != nil {
+		return nil, err
+	}
+	indexes := sortedIndexes(running)
+	if len(indexes) == 0 {
+		return nil, fmt.Errorf("Process '%s' has no running instance.", w.processType)
+	}
+	index := indexes[0]
+	connection, err := w.connect(index)
+	if err != nil {
+		return nil, err
+	}
+	for _, instanceMapping := range w.mappings {
+		instanceMapping.containerFiler.AddInstance(index, connection.ContainerFiler(instanceMapping.mapping))
+		instanceMapping.containerFiler.SetReady(index)
+	}
+	w.connections[index] = connection
+	w.since[index] = running[index]
+	return connection, nil
+}
+
+// Clients gives the current ssh client of each synchronized instance by index.
+func (w *InstanceWatcher) Clients() map[int]*SecureClient {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	clients := make(map[int]*SecureClient)
+	for index, connection := range w.connections {
+		clients[index] = connection.supervisor.Client()
+	}
+	return clients
+}
+
+// PrimaryClient gives the current ssh client of the synchronized instance with the lowest index, which is used
+// to watch remote folder, nil if no instance is synchronized.
+func (w *InstanceWatcher) PrimaryClient() *SecureClient {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	indexes := make([]int, 0, len(w.connections))
+	for index := range w.connections {
+		indexes = append(indexes, index)
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+	sort.Ints(indexes)
+	return w.connections[indexes[0]].supervisor.Client()
+}
+
+// Watch connects to other running instances and synchronizes them, then follows instances
+// which start or stop until Stop is called.
+func (w *InstanceWatcher) Watch() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		w.refresh()
+		select {
+		case <-ticker.C:
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+// Stop stops watching instances and closes every connection.
+func (w *InstanceWatcher) Stop() {
+	close(w.stopCh)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for index, connection := range w.connections {
+		w.removeInstance(index)
+		connection.Close()
+	}
+}
+
+// refresh drops instances which have stopped or restarted and synchronizes the ones which have started,
+// the lock is not held while an instance is synchronized so that Clients is never blocked by uploads.
+func (w *InstanceWatcher) refresh() {
+	running, err := w.instances()
+	if err != nil {
+		logger.Warning("Instances of process '%s' can't be retrieved: %s", w.processType, err.Error())
+		return
+	}
+	w.mutex.Lock()
+	for index, connection := range w.connections {
+		since, ok := running[index]
+		if ok && sameStart(since, w.since[index]) {
+			continue
+		}
+		if ok {
+			logger.Warning("Instance #%d has restarted, it will be synchronized again.", index)
+		} else {
+			logger.Warning("Instance #%d has stopped, changes are no longer sent to it.", index)
+		}
+		w.removeInstance(index)
+		connection.Close()
+		delete(w.connections, index)
+		delete(w.since, index)
+	}
+	if !w.isReady() {
+		w.mutex.Unlock()
+		return
+	}
+	mappings := make([]instanceMapping, 0, len(w.mappings))
+	for _, instanceMapping := range w.mappings {
+		mappings = append(mappings, *instanceMapping)
+	}
+	joining := make([]int, 0)
+	for _, index := range sortedIndexes(running) {
+		if _, ok := w.connections[index]; !ok {
+			joining = append(joining, index)
+		}
+	}
+	w.mutex.Unlock()
+
+	for _, index := range joining {
+		if w.isStopped() {
+			return
+		}
+		logger.Info("Connecting to instance #%d ...", index)
+		connection, err := w.connect(index)
+		if err != nil {
+			logger.Error("Instance #%d can't be reached: %s", index, err.Error())
+			continue
+		}
+		err = w.join(index, connection, mappings)
+		w.mutex.Lock()
+		if err == nil && w.isStopped() {
+			err = errors.New("Sync is stopping.")
+		}
+		if err != nil {
+			w.removeInstance(index)
+			w.mutex.Unlock()
+			logger.Error("Instance #%d can't be synchronized: %s", index, err.Error())
+			connection.Close()
+			continue
+		}
+		w.connections[index] = connection
+		w.since[index] = running[index]
+		w.mutex.Unlock()
+		logger.Info("Instance #%d is synchronized.\n", index)
+	}
+}
+func (w *InstanceWatcher) isStopped() bool {
+	select {
+	case <-w.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+func (w *InstanceWatcher) join(index int, connection *InstanceConnection, mappings []instanceMapping) error {
+	for _, instanceMapping := range mappings {
+		containerFiler := connection.ContainerFiler(instanceMapping.mapping)
+		// changes are sent to the instance while it's synchronized to not miss any of them
+		instanceMapping.containerFiler.AddInstance(index, containerFiler)
+		err := instanceMapping.onJoin(containerFiler)
+		if err != nil {
+			return err
+		}
+	}
+	for _, instanceMapping := range mappings {
+		instanceMapping.containerFiler.SetReady(index)
+	}
+	return nil
+}
+func (w *InstanceWatcher) removeInstance(index int) {
+	for _, instanceMapping := range w.mappings {
+		instanceMapping.containerFiler.RemoveInstance(index)
+	}
+}
+func (w *InstanceWatcher) isReady() bool {
+	for _, instanceMapping := range w.mappings {
+		if instanceMapping.onJoin == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedIndexes(instances map[int]time.Time) []int {
+	indexes := make([]int, 0, len(instances))
+	for index := range instances {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// sameStart tells if two start times are the same, start times computed from uptime can differ by a few seconds.
+func sameStart(since, other time.Time) bool {
+	diff := since.Sub(other)
+	return diff < INSTANCE_START_TOLERANCE && diff > -INSTANCE_START_TOLERANCE
+}
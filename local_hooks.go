@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// BUILD_FILE_ENV is the environment variable giving to build hooks the changed file, relative to source folder.
+const BUILD_FILE_ENV = "CFSYNC_FILE"
+
+// BuildHook is a local command run in source folder before uploading files matching its pattern,
+// when outputs are set the files they match are uploaded instead of the changed file.
+type BuildHook struct {
+	Pattern string
+	Command string
+	Outputs []string
+}
+
+// Match tells if relPath, relative to source folder, is matched by the pattern of the hook.
+func (h BuildHook) Match(relPath string) bool {
+	return matchPattern(h.Pattern, relPath)
+}
+
+// Run runs the hook for the changed file relPath and gives the absolute paths of its outputs,
+// output of the command is part of the error when it fails.
+func (h BuildHook) Run(sourceDir, relPath string) ([]string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", h.Command)
+	} else {
+		cmd = exec.Command("sh", "-c", h.Command)
+	}
+	cmd.Dir = sourceDir
+	cmd.Env = append(os.Environ(), BUILD_FILE_ENV + "=" + relPath)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(output))
+		if msg == "" {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s\n%s", err.Error(), msg)
+	}
+	outputs := make([]string, 0)
+	for _, output := range h.Outputs {
+		matches, err := filepath.Glob(filepath.Join(sourceDir, filepath.FromSlash(output)))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("Output '%s' has not been produced.", output)
+		}
+		outputs = append(outputs, matches...)
+	}
+	sort.Strings(outputs)
+	return outputs, nil
+}
+
+// build runs build hooks matching the local file path before it's uploaded, built tells if outputs of the hooks
+// have been uploaded instead of the file. When a hook fails the file is not uploaded.
+func (s *Sync) build(path string) (built bool, err error) {
+	relPath := s.TrimPath(path)
+	hooks := make([]BuildHook, 0)
+	for _, hook := range s.buildHooks {
+		if hook.Match(relPath) {
+			hooks = append(hooks, hook)
+		}
+	}
+	if len(hooks) == 0 {
+		return false, nil
+	}
+	stat, err := os.Stat(path)
+	if err != nil || stat.IsDir() {
+		return false, nil
+	}
+	for _, hook := range hooks {
+		if s.dryRun {
+			logger.Info("[dry-run] Would run build hook '%s' for file '%s'.", hook.Command, TruncatePath(path))
+			built = built || len(hook.Outputs) > 0
+			continue
+		}
+		logger.Info("Running build hook '%s' for file '%s' ...", hook.Command, TruncatePath(path))
+		outputs, err := hook.Run(s.sourceDir, relPath)
+		if err != nil {
+			return true, fmt.Errorf("Build hook '%s' has failed, file '%s' has not been uploaded: %s", hook.Command, TruncatePath(path), err.Error())
+		}
+		logger.Info("Finished build hook '%s'.", hook.Command)
+		if len(hook.Outputs) == 0 {
+			continue
+		}
+		built = true
+		for _, output := range outputs {
+			// events of outputs written by the hook are ignored, outputs are sent here
+			s.markEcho(output)
+			err = s.upload(output, false)
+			s.markEcho(output)
+			if err != nil {
+				return true, err
+			}
+		}
+	}
+	return built, nil
+}
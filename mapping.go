@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Mapping is a source folder synchronized with a target folder inside the container.
+type Mapping struct {
+	SourceDir  string
+	TargetDir  string
+	SyncIgnore *SyncIgnore
+}
+
+// ParseMapping parses a mapping written as local:remote, the last colon is used as separator
+// to allow drive letters in local path.
+func ParseMapping(value string) (string, string, error) {
+	i := strings.LastIndex(value, ":")
+	if i <= 0 || i == len(value) - 1 {
+		return "", "", fmt.Errorf("Mapping '%s' must be written as local:remote.", value)
+	}
+	return value[:i], value[i + 1:], nil
+}
+
+// CheckMappings returns an error when two mappings use the same source folder or the same target folder,
+// or when a folder is inside another one: it would be synchronized by both mappings.
+func CheckMappings(mappings []Mapping) error {
+	sourceDirs := []string{}
+	targetDirs := []string{}
+	for _, mapping := range mappings {
+		sourceDir, err := filepath.Abs(mapping.SourceDir)
+		if err != nil {
+			return err
+		}
+		targetDir := path.Clean(mapping.TargetDir)
+		for _, otherDir := range sourceDirs {
+			if sourceDir == otherDir {
+				return fmt.Errorf("Source folder '%s' is used by several mappings.", mapping.SourceDir)
+			}
+			if isNestedDir(sourceDir, otherDir, string(filepath.Separator)) {
+				return fmt.Errorf("Source folders '%s' and '%s' are nested.", otherDir, sourceDir)
+			}
+		}
+		for _, otherDir := range targetDirs {
+			if targetDir == otherDir {
+				return fmt.Errorf("Target folder '%s' is used by several mappings.", targetDir)
+			}
+			if isNestedDir(targetDir, otherDir, "/") {
+				return fmt.Errorf("Target folders '%s' and '%s' are nested.", otherDir, targetDir)
+			}
+		}
+		sourceDirs = append(sourceDirs, sourceDir)
+		targetDirs = append(targetDirs, targetDir)
+	}
+	return nil
+}
+
+// isNestedDir tells if one of the two clean folders is inside the other one.
+func isNestedDir(dir, otherDir, separator string) bool {
+	return strings.HasPrefix(dir, strings.TrimSuffix(otherDir, separator) + separator) ||
+		strings.HasPrefix(otherDir, strings.TrimSuffix(dir, separator) + separator)
+}
+
+// toSourceDir gives the absolute path of a source folder, the folder is created if it doesn't exist, unless dryRun is true.
+func toSourceDir(sourceDir string, dryRun bool) (string, error) {
+	sourceDir, err := filepath.Abs(sourceDir)
+	if err != nil {
+		return "", err
+	}
+	dirExists, err := FileExists(sourceDir)
+	if err != nil {
+		return "", err
+	}
+	if !dirExists && dryRun {
+		logger.Info("[dry-run] Would create source folder '%s'.", TruncatePath(sourceDir))
+	} else if !dirExists {
+		err = os.MkdirAll(sourceDir, 0755)
+		if err != nil {
+			return "", err
+		}
+	}
+	return sourceDir, nil
+}
+
+// toTargetDir gives the path of a target folder inside the root folder of the app.
+func toTargetDir(targetDir string) string {
+	if targetDir == "" {
+		return DEFAULT_ROOT_TARGET_FOLDER
+	}
+	if !strings.HasPrefix(targetDir, "/") {
+		targetDir = "/" + targetDir
+	}
+	return DEFAULT_ROOT_TARGET_FOLDER + targetDir
+}
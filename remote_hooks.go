@@ -0,0 +1,202 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HOOK_DELAY is the time without matching upload to wait before running hooks, to run them once for a burst of changes.
+const HOOK_DELAY = 1 * time.Second
+
+// RemoteHook is a command run in the container after files matching its pattern have been uploaded.
+type RemoteHook struct {
+	Pattern string
+	Command string
+}
+
+// Match tells if remotePath, relative to root folder of the app, is matched by the pattern of the hook.
+func (h RemoteHook) Match(remotePath string) bool {
+	return matchPattern(h.Pattern, remotePath)
+}
+
+// matchPattern tells if a slash separated relative path is matched by pattern. Like in .gitignore, a pattern
+// without slash matches names in any folder, a pattern ending with a slash matches content of a folder
+// and ** matches any number of folders.
+func matchPattern(pattern, relPath string) bool {
+	pattern = strings.TrimPrefix(pattern, "/")
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "**"
+	}
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(relPath, "/"))
+}
+
+func matchSegments(patterns, names []string) bool {
+	if len(patterns) == 0 {
+		return len(names) == 0
+	}
+	if patterns[0] == "**" {
+		for i := 0; i <= len(names); i++ {
+			if matchSegments(patterns[1:], names[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(names) == 0 {
+		return false
+	}
+	matched, err := path.Match(patterns[0], names[0])
+	if err != nil || !matched {
+		return false
+	}
+	return matchSegments(patterns[1:], names[1:])
+}
+
+// HookRunner runs remote hooks through ssh when uploads matching them are finished.
+// clients gives the ssh client of each instance where hooks must be run.
+type HookRunner struct {
+	hooks    []RemoteHook
+	clients  func() map[int]*SecureClient
+	pending  map[int]bool
+	timer    *time.Timer
+	delay    time.Duration
+	dryRun   bool
+	mutex    *sync.Mutex
+	runMutex *sync.Mutex
+}
+
+func NewHookRunner(hooks []RemoteHook, clients func() map[int]*SecureClient) *HookRunner {
+	return &HookRunner{
+		hooks: hooks,
+		clients: clients,
+		pending: make(map[int]bool),
+		delay: HOOK_DELAY,
+		mutex: &sync.Mutex{},
+		runMutex: &sync.Mutex{},
+	}
+}
+
+// Notify must be called when remotePath has been changed in container, hooks matching it are run
+// when no other matching change happened during the delay.
+func (r *HookRunner) Notify(remotePath string) {
+	relPath := strings.TrimPrefix(strings.TrimPrefix(remotePath, DEFAULT_ROOT_TARGET_FOLDER), "/")
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	matched := false
+	for i, hook := range r.hooks {
+		if hook.Match(relPath) {
+			r.pending[i] = true
+			matched = true
+		}
+	}
+	if !matched {
+		return
+	}
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.timer = time.AfterFunc(r.delay, r.runPending)
+}
+func (r *HookRunner) SetDryRun(dryRun bool) {
+	r.dryRun = dryRun
+}
+func (r *HookRunner) runPending() {
+	// hooks are never run concurrently, changes made meanwhile trigger a new run afterwards
+	r.runMutex.Lock()
+	defer r.runMutex.Unlock()
+	r.mutex.Lock()
+	indexes := make([]int, 0, len(r.pending))
+	for i := range r.pending {
+		indexes = append(indexes, i)
+	}
+	r.pending = make(map[int]bool)
+	r.mutex.Unlock()
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		hook := r.hooks[i]
+		if r.dryRun {
+			logger.Info("[dry-run] Would run hook '%s' for changes in '%s'.", hook.Command, hook.Pattern)
+			continue
+		}
+		clients := r.clients()
+		instances := make([]int, 0, len(clients))
+		for instance := range clients {
+			instances = append(instances, instance)
+		}
+		sort.Ints(instances)
+		for _, instance := range instances {
+			r.run(hook, instance, clients[instance], len(clients) > 1)
+		}
+	}
+}
+
+// run executes hook in an exec session, output of the command is sent to the logger line by line.
+func (r *HookRunner) run(hook RemoteHook, instance int, client *SecureClient, showInstance bool) {
+	prefix := "[hook] "
+	if showInstance {
+		prefix = "[hook #" + strconv.Itoa(instance) + "] "
+	}
+	logger.Info("Running hook '%s' for changes in '%s' ...", hook.Command, hook.Pattern)
+	session, err := client.NewSession()
+	if err != nil {
+		logger.Error("Hook '%s' can't be started: %s", hook.Command, err.Error())
+		return
+	}
+	defer session.Close()
+	stdout := newLogWriter(prefix, logger.Info)
+	stderr := newLogWriter(prefix, logger.Warning)
+	session.Stdout = stdout
+	session.Stderr = stderr
+	err = session.Run(hook.Command)
+	stdout.Flush()
+	stderr.Flush()
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		logger.Error("Hook '%s' has failed with exit status %d.", hook.Command, exitErr.ExitStatus())
+		return
+	}
+	if err != nil {
+		logger.Error("Hook '%s' has failed: %s", hook.Command, err.Error())
+		return
+	}
+	logger.Info("Hook '%s' finished with exit status 0.", hook.Command)
+}
+
+// logWriter sends each line written to it to a log function.
+type logWriter struct {
+	prefix string
+	log    func(a ...interface{})
+	buffer []byte
+}
+
+func newLogWriter(prefix string, log func(a ...interface{})) *logWriter {
+	return &logWriter{
+		prefix: prefix,
+		log: log,
+	}
+}
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buffer = append(w.buffer, p...)
+	for {
+		i := strings.IndexByte(string(w.buffer), '\n')
+		if i < 0 {
+			break
+		}
+		w.log("%s%s", w.prefix, strings.TrimRight(string(w.buffer[:i]), "\r"))
+		w.buffer = w.buffer[i + 1:]
+	}
+	return len(p), nil
+}
+func (w *logWriter) Flush() {
+	if len(w.buffer) > 0 {
+		w.log("%s%s", w.prefix, string(w.buffer))
+		w.buffer = nil
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rjeczalik/notify"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_POLL_INTERVAL = 2 * time.Second
+	REMOTE_ECHO_DELAY     = 2 * time.Second
+)
+
+// RemoteEvent is an event which happened inside the container, it is sent in the same channel
+// as local events with the local path corresponding to the remote file.
+type RemoteEvent struct {
+	event      notify.Event
+	path       string
+	remotePath string
+	isDir      bool
+}
+
+func (e RemoteEvent) Event() notify.Event {
+	return e.event
+}
+func (e RemoteEvent) Path() string {
+	return e.path
+}
+func (e RemoteEvent) Sys() interface{} {
+	return nil
+}
+func (e RemoteEvent) RemotePath() string {
+	return e.remotePath
+}
+func (e RemoteEvent) IsDir() bool {
+	return e.isDir
+}
+
+type RemoteWatcher struct {
+	containerFiler ContainerFiler
+	// client gives the current ssh client, it's replaced when the connection is restored or when the
+	// watched instance stops
+	client         func() *SecureClient
+	syncIgnore     *SyncIgnore
+	targetDir      string
+	interval       time.Duration
+	snapshot       map[string]os.FileInfo
+	echoes         map[string]time.Time
+	mutex          *sync.Mutex
+	stopCh         chan struct{}
+}
+
+func NewRemoteWatcher(containerFiler ContainerFiler, client func() *SecureClient, syncIgnore *SyncIgnore, targetDir string, interval time.Duration) *RemoteWatcher {
+	if interval <= 0 {
+		interval = DEFAULT_POLL_INTERVAL
+	}
+	return &RemoteWatcher{
+		containerFiler: containerFiler,
+		client: client,
+		syncIgnore: syncIgnore,
+		targetDir: strings.TrimSuffix(targetDir, "/"),
+		interval: interval,
+		snapshot: make(map[string]os.FileInfo),
+		echoes: make(map[string]time.Time),
+		mutex: &sync.Mutex{},
+		stopCh: make(chan struct{}),
+	}
+}
+
+// Watch sends remote changes to eventChan until Stop is called, toLocalPath converts a path relative
+// to the target dir to its local path.
+// inotifywait is used when available inside the container, otherwise remote folder is polled.
+func (w *RemoteWatcher) Watch(eventChan chan <- notify.EventInfo, toLocalPath func(string) string) error {
+	snapshot, err := w.containerFiler.ListRemoteFiles(w.targetDir)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	w.snapshot = snapshot
+	w.mutex.Unlock()
+	for {
+		client := w.client()
+		if client == nil || !w.hasInotify(client) {
+			break
+		}
+		logger.Info("Start watching for change in remote folder '%s' with inotifywait\n", TruncatePath(w.targetDir))
+		err = w.watchInotify(client, eventChan, toLocalPath)
+		select {
+		case <-w.stopCh:
+			return nil
+		default:
+		}
+		if err != nil {
+			logger.Warning("Watching remote folder with inotifywait has stopped: %s", err.Error())
+		}
+		// changes made while inotifywait was not running are found by a scan, which waits for the connection
+		// to be restored, inotifywait is started again with the new connection or on another instance
+		err = w.scan(eventChan, toLocalPath)
+		if err != nil || w.client() == client {
+			break
+		}
+	}
+	logger.Info("Start polling remote folder '%s' every %s\n", TruncatePath(w.targetDir), w.interval.String())
+	return w.watchPolling(eventChan, toLocalPath)
+}
+func (w *RemoteWatcher) Stop() {
+	close(w.stopCh)
+}
+
+// Acknowledge must be called after a change has been made on remote path by the sync itself
+// to not send back the change as a remote event.
+// stat is the remote file info after the change, nil if remote file has been removed.
+func (w *RemoteWatcher) Acknowledge(path string, stat os.FileInfo) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.echoes[path] = time.Now().Add(REMOTE_ECHO_DELAY)
+	if stat == nil {
+		delete(w.snapshot, path)
+		return
+	}
+	if !stat.IsDir() {
+		w.snapshot[path] = stat
+	}
+}
+func (w *RemoteWatcher) isEcho(path string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	until, ok := w.echoes[path]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(w.echoes, path)
+		return false
+	}
+	return true
+}
+func (w *RemoteWatcher) watchPolling(eventChan chan <- notify.EventInfo, toLocalPath func(string) string) error {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stopCh:
+			return nil
+		case <-ticker.C:
+		}
+		err := w.scan(eventChan, toLocalPath)
+		if err != nil {
+			logger.Error("Polling remote folder has errored: " + err.Error())
+		}
+	}
+}
+
+// scan sends changes made in remote folder since the last snapshot.
+func (w *RemoteWatcher) scan(eventChan chan <- notify.EventInfo, toLocalPath func(string) string) error {
+	files, err := w.containerFiler.ListRemoteFiles(w.targetDir)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	oldSnapshot := w.snapshot
+	w.snapshot = files
+	w.mutex.Unlock()
+	for path, stat := range files {
+		oldStat, ok := oldSnapshot[path]
+		if ok && oldStat.Size() == stat.Size() && oldStat.ModTime().Equal(stat.ModTime()) {
+			continue
+		}
+		event := notify.Write
+		if !ok {
+			event = notify.Create
+		}
+		w.send(eventChan, toLocalPath, event, path, false)
+	}
+	for path := range oldSnapshot {
+		if _, ok := files[path]; !ok {
+			w.send(eventChan, toLocalPath, notify.Remove, path, false)
+		}
+	}
+	return nil
+}
+func (w *RemoteWatcher) hasInotify(client *SecureClient) bool {
+	session, err := client.NewSession()
+	if err != nil {
+		return false
+	}
+	defer session.Close()
+	return session.Run("command -v inotifywait") == nil
+}
+func (w *RemoteWatcher) watchInotify(client *SecureClient, eventChan chan <- notify.EventInfo, toLocalPath func(string) string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = session.Start(fmt.Sprintf("inotifywait -m -r -q -e close_write,create,delete,moved_from,moved_to --format '%%e|%%w%%f' %s",
+		ShellQuote(w.targetDir)))
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-w.stopCh
+		session.Close()
+	}()
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		splitted := strings.SplitN(scanner.Text(), "|", 2)
+		if len(splitted) != 2 {
+			continue
+		}
+		path := strings.TrimPrefix(strings.TrimPrefix(splitted[1], w.targetDir), "/")
+		if path == "" {
+			continue
+		}
+		flags := "," + splitted[0] + ","
+		isDir := strings.Contains(flags, ",ISDIR,")
+		switch {
+		case strings.Contains(flags, ",CLOSE_WRITE,"):
+			w.send(eventChan, toLocalPath, notify.Write, path, isDir)
+		case strings.Contains(flags, ",CREATE,") && isDir, strings.Contains(flags, ",MOVED_TO,"):
+			w.send(eventChan, toLocalPath, notify.Create, path, isDir)
+		case strings.Contains(flags, ",DELETE,"), strings.Contains(flags, ",MOVED_FROM,"):
+			w.send(eventChan, toLocalPath, notify.Remove, path, isDir)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return session.Wait()
+}
+func (w *RemoteWatcher) send(eventChan chan <- notify.EventInfo, toLocalPath func(string) string, event notify.Event, path string, isDir bool) {
+	if isTempFile(path) || w.isEcho(path) {
+		return
+	}
+	remotePath := w.toRemotePath(path)
+	if w.syncIgnore != nil && w.syncIgnore.Match(remotePath, isDir) {
+		return
+	}
+	eventChan <- &RemoteEvent{
+		event: event,
+		path: toLocalPath(path),
+		remotePath: remotePath,
+		isDir: isDir,
+	}
+}
+func (w RemoteWatcher) toRemotePath(path string) string {
+	return w.targetDir + "/" + path
+}
@@ -24,6 +24,8 @@ const (
 	md5FingerprintLength          = 47 // inclusive of space between bytes
 	hexSha1FingerprintLength      = 59 // inclusive of space between bytes
 	base64Sha256FingerprintLength = 43
+	// dialTimeout bounds the tcp connect and, through a deadline set by secureDialer, the ssh handshake
+	dialTimeout = 30 * time.Second
 )
 
 //go:generate counterfeiter . SecureDialer
@@ -67,6 +69,7 @@ type SecureShell struct {
 	sshEndpointFingerprint string
 	sshEndpoint            string
 	token                  string
+	processGUID            string
 	secureClient           *SecureClient
 	opts                   *options.SSHOptions
 
@@ -79,15 +82,7 @@ func (c *SecureShell) Connect(opts *options.SSHOptions) error {
 		return err
 	}
 
-	clientConfig := &ssh.ClientConfig{
-		User: fmt.Sprintf("cf:%s/%d", c.app.GUID, opts.Index),
-		Auth: []ssh.AuthMethod{
-			ssh.Password(c.token),
-		},
-		HostKeyCallback: fingerprintCallback(opts, c.sshEndpointFingerprint),
-	}
-
-	secureClient, err := c.secureDialer.Dial("tcp", c.sshEndpoint, clientConfig)
+	secureClient, err := c.dial(opts, c.token)
 	if err != nil {
 		return err
 	}
@@ -97,6 +92,35 @@ func (c *SecureShell) Connect(opts *options.SSHOptions) error {
 	return nil
 }
 
+func (c *SecureShell) dial(opts *options.SSHOptions, token string) (*SecureClient, error) {
+	// ssh user is the guid of the process, it's the app guid for web process
+	guid := c.app.GUID
+	if c.processGUID != "" {
+		guid = c.processGUID
+	}
+	clientConfig := &ssh.ClientConfig{
+		User: fmt.Sprintf("cf:%s/%d", guid, opts.Index),
+		Auth: []ssh.AuthMethod{
+			ssh.Password(token),
+		},
+		HostKeyCallback: fingerprintCallback(opts, c.sshEndpointFingerprint),
+		Timeout:         dialTimeout,
+	}
+
+	return c.secureDialer.Dial("tcp", c.sshEndpoint, clientConfig)
+}
+
+// SetProcessGUID makes the connection target an instance of another process than the web process.
+func (c *SecureShell) SetProcessGUID(processGUID string) {
+	c.processGUID = processGUID
+}
+
+// Redial dials again with the options of the last connection and a new one-time code,
+// the current client is not replaced.
+func (c *SecureShell) Redial(token string) (*SecureClient, error) {
+	return c.dial(c.opts, token)
+}
+
 func (c *SecureShell) Close() error {
 	for _, listener := range c.localListeners {
 		_ = listener.Close()
@@ -264,13 +288,25 @@ func (c *SecureShell) terminalType() string {
 
 type secureDialer struct{}
 
+// Dial connects within config.Timeout, unlike ssh.Dial the timeout also applies to the ssh handshake so that a
+// server which accepts the connection but never answers doesn't block the caller.
 func (d *secureDialer) Dial(network string, address string, config *ssh.ClientConfig) (*SecureClient, error) {
-	client, err := ssh.Dial(network, address, config)
+	conn, err := net.DialTimeout(network, address, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(config.Timeout))
+	}
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, address, config)
 	if err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
+	_ = conn.SetDeadline(time.Time{})
 
-	return &SecureClient{client: client}, nil
+	return &SecureClient{client: ssh.NewClient(clientConn, chans, reqs)}, nil
 }
 
 func DefaultSecureDialer() SecureDialer {
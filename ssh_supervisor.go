@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	KEEPALIVE_REQUEST     = "keepalive@cloudfoundry.org"
+	PING_TIMEOUT          = 10 * time.Second
+	RECONNECT_MIN_BACKOFF = 1 * time.Second
+	RECONNECT_MAX_BACKOFF = 1 * time.Minute
+	// RECONNECT_MAX_ATTEMPTS and RECONNECT_TIMEOUT bound a reconnection, operations waiting for it fail after them.
+	RECONNECT_MAX_ATTEMPTS = 10
+	RECONNECT_TIMEOUT      = 10 * time.Minute
+)
+
+// ConnectionSupervisor watches the ssh connection of a SecureShell and reconnects it when it's broken,
+// a new one-time code is asked with refreshToken for each attempt.
+type ConnectionSupervisor struct {
+	secureShell       *SecureShell
+	refreshToken      func() (string, error)
+	keepAliveInterval time.Duration
+	// reconnecting is closed when the reconnection in progress is finished, nil when there is none
+	reconnecting chan struct{}
+	mutex        *sync.Mutex
+	stopCh       chan struct{}
+}
+
+func NewConnectionSupervisor(secureShell *SecureShell, refreshToken func() (string, error), keepAliveInterval time.Duration) *ConnectionSupervisor {
+	return &ConnectionSupervisor{
+		secureShell: secureShell,
+		refreshToken: refreshToken,
+		keepAliveInterval: keepAliveInterval,
+		mutex: &sync.Mutex{},
+		stopCh: make(chan struct{}),
+	}
+}
+
+// Client gives the current ssh client, it doesn't wait for a reconnection in progress: operations which fail with
+// the broken client wait for it in Reconnect.
+func (s *ConnectionSupervisor) Client() *SecureClient {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.secureShell.secureClient
+}
+
+// Watch sends keepalive requests at each interval and reconnects when they are not answered, until Stop is called.
+func (s *ConnectionSupervisor) Watch() {
+	ticker := time.NewTicker(s.keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stopCh:
+			return
+		}
+		client := s.Client()
+		if s.ping(client) {
+			continue
+		}
+		logger.Warning("Connection to container has been lost: keepalive has not been answered.")
+		err := s.Reconnect(client)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}
+}
+func (s *ConnectionSupervisor) Stop() {
+	close(s.stopCh)
+}
+
+// IsBroken tells if err, returned by an operation made with client, comes from a broken connection.
+func (s *ConnectionSupervisor) IsBroken(client *SecureClient, err error) bool {
+	if client != s.Client() {
+		return true
+	}
+	if os.IsNotExist(err) || os.IsPermission(err) || os.IsExist(err) {
+		return false
+	}
+	return !s.ping(client)
+}
+
+// Reconnect replaces brokenClient by a new connection, retrying with an exponential backoff, and gives an error
+// after RECONNECT_MAX_ATTEMPTS attempts or RECONNECT_TIMEOUT.
+// Nothing is done if brokenClient has already been replaced, if a reconnection is in progress it's waited for.
+// The lock is only held to swap clients, so Client never waits.
+func (s *ConnectionSupervisor) Reconnect(brokenClient *SecureClient) error {
+	s.mutex.Lock()
+	if s.secureShell.secureClient != brokenClient {
+		s.mutex.Unlock()
+		return nil
+	}
+	if done := s.reconnecting; done != nil {
+		s.mutex.Unlock()
+		select {
+		case <-done:
+		case <-s.stopCh:
+			return errors.New("Reconnection aborted, sync is stopping.")
+		}
+		if s.Client() == brokenClient {
+			return errors.New("Reconnection to container has failed.")
+		}
+		return nil
+	}
+	done := make(chan struct{})
+	s.reconnecting = done
+	s.mutex.Unlock()
+
+	err := s.reconnect(brokenClient)
+	s.mutex.Lock()
+	s.reconnecting = nil
+	close(done)
+	s.mutex.Unlock()
+	return err
+}
+func (s *ConnectionSupervisor) reconnect(brokenClient *SecureClient) error {
+	brokenClient.Close()
+	deadline := time.Now().Add(RECONNECT_TIMEOUT)
+	backoff := RECONNECT_MIN_BACKOFF
+	for attempt := 1; ; attempt++ {
+		logger.Info("Reconnecting to container (attempt %d/%d) ...", attempt, RECONNECT_MAX_ATTEMPTS)
+		client, err := s.dial()
+		if err == nil {
+			s.mutex.Lock()
+			s.secureShell.secureClient = client
+			s.mutex.Unlock()
+			logger.Info("Reconnected to container.")
+			return nil
+		}
+		if attempt >= RECONNECT_MAX_ATTEMPTS || time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("Reconnecting to container has failed after %d attempts: %s", attempt, err.Error())
+		}
+		logger.Warning("Reconnecting to container has failed, next attempt in %s: %s", backoff.String(), err.Error())
+		select {
+		case <-time.After(backoff):
+		case <-s.stopCh:
+			return errors.New("Reconnection aborted, sync is stopping.")
+		}
+		backoff *= 2
+		if backoff > RECONNECT_MAX_BACKOFF {
+			backoff = RECONNECT_MAX_BACKOFF
+		}
+	}
+}
+func (s *ConnectionSupervisor) dial() (*SecureClient, error) {
+	token, err := s.refreshToken()
+	if err != nil {
+		return nil, err
+	}
+	return s.secureShell.Redial(token)
+}
+func (s *ConnectionSupervisor) ping(client *SecureClient) bool {
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := client.Conn().SendRequest(KEEPALIVE_REQUEST, true, nil)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err == nil
+	case <-time.After(PING_TIMEOUT):
+		return false
+	}
+}
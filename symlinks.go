@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	SYMLINKS_FOLLOW   = "follow"
+	SYMLINKS_PRESERVE = "preserve"
+	// MAX_SYMLINK_DEPTH is the number of symlinks to folders followed inside each other before considering it's a loop.
+	MAX_SYMLINK_DEPTH = 8
+)
+
+var symlinkModes []string = []string{SYMLINKS_FOLLOW, SYMLINKS_PRESERVE}
+
+func CheckSymlinkMode(mode string) error {
+	for _, symlinkMode := range symlinkModes {
+		if mode == symlinkMode {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid symlink mode '%s', valid modes are: %s.", mode, strings.Join(symlinkModes, ", "))
+}
+func isSymlink(stat os.FileInfo) bool {
+	return stat != nil && stat.Mode() & os.ModeSymlink != 0
+}
+
+// isLoop tells if following a symlink to target (resolved) would walk again one of the folders being walked,
+// ancestors are the resolved paths of these folders and depth the number of symlinks already followed to reach them.
+func isLoop(target string, ancestors []string, depth int, separator string) bool {
+	if depth >= MAX_SYMLINK_DEPTH {
+		return true
+	}
+	for _, ancestor := range ancestors {
+		if ancestor == target || strings.HasPrefix(ancestor, strings.TrimSuffix(target, separator) + separator) {
+			return true
+		}
+	}
+	return false
+}
+func withAncestor(ancestors []string, ancestor string) []string {
+	return append(ancestors[:len(ancestors):len(ancestors)], ancestor)
+}
+
+// walk calls walkFn for each file and folder of root in container, when walkFn returns filepath.SkipDir on a folder
+// its content is skipped. Symlinks are given as is when they are preserved, otherwise they are replaced by what they
+// point to and symlinks to folders are walked unless they make a loop.
+func (f ContainerFilerSftp) walk(root string, walkFn func(remotePath string, stat os.FileInfo) error) error {
+	root = strings.TrimSuffix(root, "/")
+	entries, err := f.client.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	return f.walkEntries(root, []string{root}, 0, entries, walkFn)
+}
+func (f ContainerFilerSftp) walkEntries(dir string, ancestors []string, depth int, entries []os.FileInfo, walkFn func(remotePath string, stat os.FileInfo) error) error {
+	resolvedDir := ancestors[len(ancestors) - 1]
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	for _, entry := range entries {
+		remotePath := dir + "/" + entry.Name()
+		resolvedPath := resolvedDir + "/" + entry.Name()
+		childDepth := depth
+		stat := entry
+		if isSymlink(entry) && f.symlinks != SYMLINKS_PRESERVE {
+			var err error
+			stat, err = f.client.Stat(remotePath)
+			if isSkippedWalkError(err) {
+				logger.Warning("Symlink '%s' is broken, it's ignored.", TruncatePath(remotePath))
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if stat.IsDir() {
+				target, err := f.client.ReadLink(remotePath)
+				if err != nil {
+					return err
+				}
+				if !path.IsAbs(target) {
+					target = path.Join(resolvedDir, target)
+				}
+				if isLoop(target, ancestors, depth, "/") {
+					logger.Warning("Symlink '%s' makes a loop, it's not followed.", TruncatePath(remotePath))
+					continue
+				}
+				resolvedPath = target
+				childDepth++
+			}
+		}
+		err := walkFn(remotePath, stat)
+		if err == filepath.SkipDir {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !stat.IsDir() {
+			continue
+		}
+		children, err := f.client.ReadDir(remotePath)
+		if isSkippedWalkError(err) {
+			logger.Warning("Folder '%s' can't be read, it's ignored: %s", TruncatePath(remotePath), err.Error())
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = f.walkEntries(remotePath, withAncestor(ancestors, resolvedPath), childDepth, children, walkFn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isSkippedWalkError tells if a remote folder or symlink can be skipped during a walk because it can't be read or
+// has been removed meanwhile. Other errors (e.g. a lost connection) stop the walk, a partial listing would be taken
+// as deleted files by callers.
+func isSkippedWalkError(err error) bool {
+	return err != nil && (os.IsNotExist(err) || os.IsPermission(err))
+}
+
+// Symlink creates remotePath as a symlink to target, replacing what exists at this path.
+func (f ContainerFilerSftp) Symlink(target, remotePath string) error {
+	logger.Info("Creating symlink '%s' to '%s' ...", TruncatePath(remotePath), target)
+	err := f.client.MkdirAll(path.Dir(remotePath))
+	if err != nil {
+		return err
+	}
+	stat, err := f.client.Lstat(remotePath)
+	if err == nil && !stat.IsDir() {
+		f.client.Remove(remotePath)
+	}
+	err = f.client.Symlink(target, remotePath)
+	if err != nil {
+		return err
+	}
+	logger.Info("Finished creating symlink '%s'.", TruncatePath(remotePath))
+	return nil
+}
+func (f ContainerFilerSftp) ReadLink(remotePath string) (string, error) {
+	return f.client.ReadLink(remotePath)
+}
+
+// downloadSymlink recreates locally the remote symlink remotePath.
+func (f ContainerFilerSftp) downloadSymlink(remotePath, localPath string) error {
+	target, err := f.client.ReadLink(remotePath)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(localPath), 0755)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Lstat(localPath)
+	if err == nil && !stat.IsDir() {
+		os.Remove(localPath)
+	}
+	err = os.Symlink(filepath.FromSlash(target), localPath)
+	if err != nil {
+		return err
+	}
+	logger.Info("Symlink '%s' to '%s' created in '%s'", TruncatePath(remotePath), target, filepath.FromSlash(TruncatePath(localPath)))
+	return nil
+}
+func (f ContainerFilerSftp) localStat(localPath string) (os.FileInfo, error) {
+	if f.symlinks == SYMLINKS_PRESERVE {
+		return os.Lstat(localPath)
+	}
+	return os.Stat(localPath)
+}
+func (f *ContainerFilerSftp) SetSymlinks(symlinks string) {
+	f.symlinks = symlinks
+}
+
+// walkLocal walks root like filepath.Walk, symlinks to folders are followed unless symlinks are preserved
+// or they make a loop.
+func (s Sync) walkLocal(root string, walkFn filepath.WalkFunc) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return walkFn(root, info, err)
+	}
+	err = s.walkLocalPath(root, info, []string{resolvedRoot}, 0, walkFn)
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+func (s Sync) walkLocalPath(localPath string, info os.FileInfo, ancestors []string, depth int, walkFn filepath.WalkFunc) error {
+	err := walkFn(localPath, info, nil)
+	if err != nil || !info.IsDir() {
+		return err
+	}
+	dir, err := os.Open(localPath)
+	if err != nil {
+		return walkFn(localPath, info, err)
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return walkFn(localPath, info, err)
+	}
+	sort.Strings(names)
+	resolvedPath := ancestors[len(ancestors) - 1]
+	for _, name := range names {
+		childPath := filepath.Join(localPath, name)
+		childResolved := filepath.Join(resolvedPath, name)
+		childDepth := depth
+		childInfo, err := os.Lstat(childPath)
+		if err != nil {
+			err = walkFn(childPath, childInfo, err)
+			if err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		if isSymlink(childInfo) && s.symlinks != SYMLINKS_PRESERVE {
+			childInfo, err = os.Stat(childPath)
+			if err != nil {
+				logger.Warning("Symlink '%s' is broken, it's ignored.", TruncatePath(childPath))
+				continue
+			}
+			if childInfo.IsDir() {
+				target, err := filepath.EvalSymlinks(childPath)
+				if err != nil || isLoop(target, ancestors, depth, string(os.PathSeparator)) {
+					logger.Warning("Symlink '%s' makes a loop, it's not followed.", TruncatePath(childPath))
+					continue
+				}
+				childResolved = target
+				childDepth++
+			}
+		}
+		err = s.walkLocalPath(childPath, childInfo, withAncestor(ancestors, childResolved), childDepth, walkFn)
+		if err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+	return nil
+}
+
+// isPreservedSymlink tells if the local path is a symlink kept as is, state of those is not recorded
+// as their target is compared instead.
+func (s Sync) isPreservedSymlink(path string) bool {
+	if s.symlinks != SYMLINKS_PRESERVE {
+		return false
+	}
+	stat, err := os.Lstat(path)
+	return err == nil && isSymlink(stat)
+}
+
+// uploadSymlink recreates in container the local symlink path when symlinks are preserved.
+func (s *Sync) uploadSymlink(path string) (bool, error) {
+	if s.symlinks != SYMLINKS_PRESERVE {
+		return false, nil
+	}
+	stat, err := os.Lstat(path)
+	if err != nil || !isSymlink(stat) {
+		return false, nil
+	}
+	target, err := os.Readlink(path)
+	if err != nil {
+		return true, err
+	}
+	err = s.containerFiler.Symlink(filepath.ToSlash(target), s.ToRemotePath(path))
+	if err != nil {
+		return true, err
+	}
+	s.synced(path)
+	s.uploaded(path)
+	return true, nil
+}
+
+func (s *Sync) SetSymlinks(symlinks string) {
+	s.symlinks = symlinks
+}
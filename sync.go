@@ -1,13 +1,25 @@
 package main
 
 import (
+	"bufio"
 	"github.com/rjeczalik/notify"
 	"path/filepath"
 	"os"
 	"errors"
 	"strings"
 	"io"
-	"strconv"
+	"sort"
+	"sync"
+	"time"
+	"os/signal"
+	"syscall"
+)
+
+const (
+	LOCAL_ECHO_DELAY = 2 * time.Second
+	// RENAME_PAIR_DELAY is the time to wait for the old path of a renamed path, when it's not received
+	// the path has been moved in source folder from outside.
+	RENAME_PAIR_DELAY = 500 * time.Millisecond
 )
 
 type Sync struct {
@@ -15,20 +27,55 @@ type Sync struct {
 	sourceDir      string
 	targetDir      string
 	eventChan      chan notify.EventInfo
+	syncIgnore     *SyncIgnore
+	remoteWatcher  *RemoteWatcher
+	instanceWatcher *InstanceWatcher
+	hookRunner     *HookRunner
+	buildHooks     []BuildHook
+	symlinks       string
+	echoes         map[string]time.Time
+	echoesMutex    *sync.Mutex
+	state          *SyncState
+	unresolved     map[string]bool
+	conflictPolicy string
+	stdin          *bufio.Reader
 	fileToRenamed  string
-	swapping       bool
+	moves          map[uint32]pendingMove
 	forceSync      bool
+	checksum       bool
+	planOnly       bool
+	debounce       time.Duration
+	parallel       int
+	dryRun         bool
+	editors        []EditorProfile
+	saving         map[string]int
+	savingId       int
+	savingMutex    *sync.Mutex
+}
+
+// moveInEvent is sent when no old path has been received for a renamed path.
+type moveInEvent struct {
+	path string
 }
 
-var ignoredExts []string = []string{"swp", "swx"}
+func (e moveInEvent) Event() notify.Event {
+	return notify.Rename
+}
+func (e moveInEvent) Path() string {
+	return e.path
+}
+func (e moveInEvent) Sys() interface{} {
+	return nil
+}
 
 func NewSync(containerFiler ContainerFiler, sourceDir, targetDir string) (*Sync, error) {
 
+	// source folder can only be missing in dry-run mode, where it's not created
 	fi, err := os.Stat(sourceDir)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
-	if !fi.IsDir() {
+	if err == nil && !fi.IsDir() {
 		return nil, errors.New("You must pass a directory, not a file in source dir")
 	}
 	sourceDir = strings.TrimSuffix(sourceDir, "/")
@@ -37,58 +84,190 @@ func NewSync(containerFiler ContainerFiler, sourceDir, targetDir string) (*Sync,
 		sourceDir: sourceDir,
 		targetDir: targetDir,
 		eventChan: make(chan notify.EventInfo, 50),
+		echoes: make(map[string]time.Time),
+		echoesMutex: &sync.Mutex{},
+		saving: make(map[string]int),
+		savingMutex: &sync.Mutex{},
+		state: NewSyncState(),
+		unresolved: make(map[string]bool),
+		stdin: stdinReader,
+		moves: make(map[uint32]pendingMove),
+		conflictPolicy: CONFLICT_LOCAL_WINS,
 	}, nil
 }
 
 func (s *Sync) Run() error {
-	err := s.syncFolder()
+	if _, err := os.Stat(s.sourceDir); s.dryRun && os.IsNotExist(err) {
+		logger.Info("[dry-run] Source folder '%s' doesn't exist, it is not watched.", TruncatePath(s.sourceDir))
+		return s.containerFiler.CopyRemoteFolder(s.sourceDir, s.targetDir)
+	}
+	err := s.state.Load(s.stateFile())
 	if err != nil {
 		return err
 	}
+	err = s.syncFolder()
+	if err != nil {
+		return err
+	}
+	if s.planOnly {
+		return nil
+	}
+	err = s.loadState()
+	if err != nil {
+		return err
+	}
+	err = s.syncEmptyDirs()
+	if err != nil {
+		return err
+	}
+	if !s.dryRun {
+		err = s.state.Save(s.stateFile())
+		if err != nil {
+			return err
+		}
+		stopCh := make(chan struct{})
+		defer func() {
+			close(stopCh)
+			// changes made since last auto save are not lost
+			if err := s.state.Save(s.stateFile()); err != nil {
+				logger.Error("Saving state has errored: " + err.Error())
+			}
+		}()
+		go s.state.AutoSave(s.stateFile(), STATE_SAVE_INTERVAL, stopCh)
+	}
+	if s.instanceWatcher != nil {
+		s.instanceWatcher.Ready(s.syncIgnore, s.uploadAll)
+	}
 	logger.Info("Start watching for change in folder '%s'\n", TruncatePath(s.sourceDir))
 	if err := notify.Watch(s.sourceDir + "/...", s.eventChan, notify.Remove, notify.Create, notify.Write, notify.Rename); err != nil {
 		return err
 	}
 	defer notify.Stop(s.eventChan)
+	if s.remoteWatcher != nil {
+		go func() {
+			err := s.remoteWatcher.Watch(s.eventChan, s.ToLocalPath)
+			if err != nil {
+				logger.Error("Watching remote folder has errored: " + err.Error())
+			}
+		}()
+		defer s.remoteWatcher.Stop()
+	}
+
+	events := s.eventChan
+	if s.debounce > 0 {
+		events = make(chan notify.EventInfo, 50)
+		go NewEventQueue(s.debounce).Run(s.eventChan, events)
+	}
+
+	var dispatcher *EventDispatcher
+	if s.parallel > 1 {
+		dispatcher = NewEventDispatcher(s.parallel, s.handleEvent)
+	}
+
+	// sync stops on interrupt, to save state before exiting
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupts)
 
 	// Block until an event is received.
-	for ei := range s.eventChan {
-		if s.isIgnored(ei.Path()) {
-			continue
+	for {
+		select {
+		case ei := <-events:
+			s.dispatch(dispatcher, ei)
+			if s.isIgnoreFileEvent(ei) {
+				// a barrier: rules are reloaded after events received before and before events received after
+				s.dispatch(dispatcher, reloadIgnoreEvent{path: ei.Path()})
+			}
+		case <-interrupts:
+			logger.Info("Stop watching for change in folder '%s'", TruncatePath(s.sourceDir))
+			return nil
 		}
-		logger.Info("Received event: '%s' for file '%s'", ei.Event().String(), TruncatePath(ei.Path()))
-		err = s.action(ei)
+	}
+}
+func (s *Sync) dispatch(dispatcher *EventDispatcher, ei notify.EventInfo) {
+	if dispatcher != nil {
+		dispatcher.Dispatch(ei)
+		return
+	}
+	s.handleEvent(ei)
+}
+func (s *Sync) handleEvent(ei notify.EventInfo) {
+	if _, ok := ei.(reloadIgnoreEvent); ok {
+		err := s.reloadSyncIgnore()
 		if err != nil {
-			logger.Error("Event has errored: " + err.Error())
+			logger.Error("Reloading ignore rules has errored: " + err.Error())
 		}
+		return
 	}
-	return nil
-}
-func (s Sync) isIgnored(path string) bool {
-	ext := filepath.Ext(path)
-	for _, ignoredExt := range ignoredExts {
-		if ext == "." + ignoredExt {
-			return true
+	if s.isIgnored(ei.Path()) {
+		return
+	}
+	if _, isRemote := ei.(*RemoteEvent); !isRemote && s.isSyncIgnored(ei.Path()) {
+		logger.Debug("Event '%s' for file '%s' skipped, it's ignored by %s.", ei.Event().String(), TruncatePath(ei.Path()), IGNORE_FILENAME)
+		return
+	}
+	if remoteEvent, ok := ei.(*RemoteEvent); ok {
+		logger.Info("Received remote event: '%s' for file '%s'", ei.Event().String(), TruncatePath(remoteEvent.RemotePath()))
+		err := s.remoteAction(remoteEvent)
+		if err != nil {
+			logger.Error("Remote event has errored: " + err.Error())
 		}
+		return
+	}
+	if s.isEcho(ei.Path()) {
+		return
+	}
+	logger.Info("Received event: '%s' for file '%s'", ei.Event().String(), TruncatePath(ei.Path()))
+	err := s.action(ei)
+	if err != nil {
+		logger.Error("Event has errored: " + err.Error())
 	}
-	_, err := strconv.Atoi(filepath.Base(path))
-	if err == nil {
+}
+
+// isIgnored tells if path is written by the sync itself (state file or conflict copy), such files are never
+// synchronized in either direction.
+// Files written by editors are only skipped while they save, see editorEvent.
+func (s Sync) isIgnored(path string) bool {
+	if strings.HasPrefix(path, s.stateFile()) {
 		return true
 	}
-	return false
+	return filepath.Ext(path) == CONFLICT_EXT
+}
+
+// isIgnoreFileEvent tells if the local event is about the ignore file of the mapping, ignore rules must be reloaded.
+func (s Sync) isIgnoreFileEvent(ei notify.EventInfo) bool {
+	if _, isRemote := ei.(*RemoteEvent); isRemote || s.syncIgnore == nil {
+		return false
+	}
+	return ei.Path() == s.syncIgnore.Path()
+}
+// isSyncIgnored tells if the local path, or one of its parent folders, matches ignore rules of the mapping.
+// A path which no longer exists is ignored when it matches either as a file or as a folder.
+func (s Sync) isSyncIgnored(path string) bool {
+	if s.syncIgnore == nil {
+		return false
+	}
+	remotePath := s.ToRemotePath(path)
+	stat, err := os.Lstat(path)
+	if err != nil {
+		return s.syncIgnore.MatchParents(remotePath, false) || s.syncIgnore.MatchParents(remotePath, true)
+	}
+	return s.syncIgnore.MatchParents(remotePath, stat.IsDir())
 }
 func (s *Sync) syncFolder() error {
 	dirIsEmpty, err := s.DirIsEmpty(s.sourceDir)
 	if err != nil {
 		return err
 	}
-	if !dirIsEmpty && !s.forceSync {
-		logger.Info("No need to synchronize from remote, directory not empty.")
-		return nil
+	if (!dirIsEmpty && !s.forceSync) || s.planOnly {
+		return s.reconcile()
 	}
 	logger.Info("Synchronizing folder '%s' from the remote folder '%s' ...", TruncatePath(s.sourceDir), TruncatePath(s.targetDir))
 	err = s.containerFiler.CopyRemoteFolder(s.sourceDir, s.targetDir)
-	if err != nil {
+	if _, ok := err.(*FilesError); ok {
+		// files which have not been downloaded are not recorded in state, they are compared again at next start
+		logger.Warning("Some files have not been downloaded: %s", err.Error())
+	} else if err != nil {
 		return err
 	}
 	logger.Info("Synchronization finished.\n")
@@ -120,6 +299,39 @@ func (s Sync) getFile(path string) (*os.File, os.FileInfo, error) {
 	return f, stat, nil
 }
 func (s *Sync) action(event notify.EventInfo) error {
+	if moveIn, ok := event.(moveInEvent); ok {
+		if s.fileToRenamed != moveIn.path {
+			return nil
+		}
+		s.fileToRenamed = ""
+		return s.moveIn(moveIn.path)
+	}
+	if moveTimeout, ok := event.(moveTimeoutEvent); ok {
+		return s.unpairedMove(moveTimeout)
+	}
+	if saveTimeout, ok := event.(saveTimeoutEvent); ok {
+		return s.finishSave(saveTimeout.path, saveTimeout.id)
+	}
+	if cookie, movedFrom, ok := moveCookie(event); ok {
+		return s.move(event.Path(), cookie, movedFrom)
+	}
+	if handled, err := s.editorEvent(event); handled {
+		return err
+	}
+	if (event.Event() == notify.Write || event.Event() == notify.Create) && s.isSaving(event.Path()) {
+		return nil
+	}
+	if _, err := os.Lstat(event.Path()); os.IsNotExist(err) && event.Event() != notify.Remove && event.Event() != notify.Rename {
+		// a temporary file moved over another one by an editor before it has been sent
+		logger.Info("File '%s' no longer exists, it's not sent.", TruncatePath(event.Path()))
+		return nil
+	}
+	if len(s.buildHooks) > 0 && (event.Event() == notify.Write || event.Event() == notify.Create) {
+		built, err := s.build(event.Path())
+		if err != nil || built {
+			return err
+		}
+	}
 	switch event.Event() {
 	case notify.Write:
 		return s.Write(event.Path())
@@ -133,97 +345,323 @@ func (s *Sync) action(event notify.EventInfo) error {
 	return nil
 }
 func (s *Sync) Delete(path string) error {
-	if s.swapping {
-		s.swapping = false
-		_, swappedFile := s.isSwapping(path)
-		logger.Warning("File '%s' finished to swap, update sent.", TruncatePath(swappedFile))
-		return s.Write(swappedFile)
+	return s.delete(path)
+}
+func (s *Sync) delete(path string) error {
+	err := s.containerFiler.Delete(s.ToRemotePath(path))
+	if err != nil {
+		return err
 	}
-	return s.containerFiler.Delete(s.ToRemotePath(path))
+	s.state.DeleteDir(s.TrimPath(path))
+	s.synced(path)
+	s.uploaded(path)
+	return nil
 }
 func (s *Sync) Write(path string) error {
-	if s.swapping {
-		return nil
+	return s.upload(path, true)
+}
+func (s *Sync) upload(path string, checkConflict bool) error {
+	isSymlink, err := s.uploadSymlink(path)
+	if isSymlink {
+		return err
 	}
 	f, stat, err := s.getFile(path)
 	if err != nil {
 		return err
 	}
-	return s.containerFiler.CopyContent(f,
+	defer f.Close()
+	if checkConflict {
+		proceed, err := s.checkUploadConflict(path, stat)
+		if err != nil || !proceed {
+			return err
+		}
+	}
+	err = s.containerFiler.CopyContent(f,
 		stat.Size(),
 		s.ToRemotePath(path),
 		stat.Mode(),
+		stat.ModTime(),
 	)
+	if err != nil {
+		return err
+	}
+	s.synced(path)
+	s.uploaded(path)
+	return nil
+}
+func (s *Sync) download(remotePath, path string, checkConflict bool) error {
+	if checkConflict {
+		remoteStat, err := s.containerFiler.Stat(remotePath)
+		if err != nil {
+			return err
+		}
+		proceed, err := s.checkDownloadConflict(path, remoteStat)
+		if err != nil || !proceed {
+			return err
+		}
+	}
+	s.markEcho(path)
+	defer s.markEcho(path)
+	err := s.containerFiler.Download(remotePath, path)
+	if err != nil {
+		return err
+	}
+	s.synced(path)
+	return nil
 }
 func (s *Sync) Create(path string) error {
-	if s.swapping {
-		return nil
+	lstat, err := os.Lstat(path)
+	if err != nil {
+		return err
 	}
-	isSwapping, swappingFile := s.isSwapping(path)
-	if isSwapping {
-		s.swapping = true
-		logger.Warning("File '%s' is swapping, next events will be ignored.", TruncatePath(swappingFile))
-		return nil
+	if isSymlink(lstat) && s.symlinks == SYMLINKS_PRESERVE {
+		return s.upload(path, true)
 	}
-	f, stat, err := s.getFile(path)
+	stat, err := os.Stat(path)
 	if err != nil {
 		return err
 	}
 	if stat.IsDir() {
-		return s.containerFiler.CreateFolders(s.targetDir, s.TrimPath(path))
+		// folder may have been created with its content (copy, archive extraction...)
+		return s.uploadFolder(path)
 	} else {
-		return s.containerFiler.CopyContent(f,
-			stat.Size(),
-			s.ToRemotePath(path),
-			stat.Mode(),
-		)
+		return s.upload(path, true)
 	}
 }
+// Rename pairs both sides of a move when the watcher gives no cookie for it, the new path is the one which exists.
 func (s *Sync) Rename(path string) error {
-	if s.swapping {
-		return nil
-	}
 	exists, err := FileExists(path)
 	if err != nil {
 		return err
 	}
-	if !exists {
-		isSwapping, swappingFile := s.isSwapping(path)
-		if isSwapping {
-			s.swapping = true
-			logger.Warning("File '%s' is swapping, next events will be ignored.", TruncatePath(swappingFile))
+	if s.fileToRenamed == "" && !exists {
+		if _, isEditorFile := s.editorFile(path); isEditorFile {
 			return nil
 		}
-	}
-	if s.fileToRenamed == "" && !exists {
-		return s.containerFiler.Delete(s.ToRemotePath(path))
+		return s.delete(path)
 	}
 	if exists {
+		if s.fileToRenamed != "" && s.fileToRenamed != path {
+			// previous path has not been renamed, it has been moved in from outside
+			err = s.moveIn(s.fileToRenamed)
+			if err != nil {
+				logger.Error("Event has errored: " + err.Error())
+			}
+		}
 		s.fileToRenamed = path
+		go func() {
+			time.Sleep(RENAME_PAIR_DELAY)
+			s.eventChan <- moveInEvent{path: path}
+		}()
 		return nil
 	}
 	defer func() {
 		s.fileToRenamed = ""
 	}()
-	return s.containerFiler.Rename(s.ToRemotePath(path), s.ToRemotePath(s.fileToRenamed))
+	return s.rename(path, s.fileToRenamed)
 }
-func (s Sync) isSwapping(path string) (isSwapping bool, pathRenamed string) {
-	return s.isSwappingWithLastState(path, false)
+
+// moveIn sends a path which has been moved in source folder from outside, a folder is sent with its content.
+func (s *Sync) moveIn(path string) error {
+	if _, isEditorFile := s.editorFile(path); isEditorFile {
+		return nil
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	logger.Info("Path '%s' has been moved in source folder.", TruncatePath(path))
+	if stat.IsDir() && !s.isPreservedSymlink(path) {
+		return s.uploadFolder(path)
+	}
+	return s.upload(path, true)
 }
-func (s Sync) isSwappingWithLastState(path string, state bool) (isSwapping bool, pathRenamed string) {
-	pathRenamed = path
-	ext := filepath.Ext(path)
-	if ext == "." {
-		isSwapping = false
-		return
+func (s *Sync) remoteAction(event *RemoteEvent) error {
+	path := event.Path()
+	s.markEcho(path)
+	defer s.markEcho(path)
+	switch event.Event() {
+	case notify.Create, notify.Write:
+		if event.IsDir() && s.dryRun {
+			logger.Info("[dry-run] Would create local folder '%s'.", TruncatePath(path))
+			return s.downloadFolder(path, event.RemotePath())
+		}
+		if event.IsDir() {
+			err := os.MkdirAll(path, 0755)
+			if err != nil {
+				return err
+			}
+			// a folder moved in remote folder comes with its content
+			return s.downloadFolder(path, event.RemotePath())
+		}
+		return s.download(event.RemotePath(), path, true)
+	case notify.Remove:
+		if s.dryRun {
+			logger.Info("[dry-run] Would delete local path '%s'.", TruncatePath(path))
+			return nil
+		}
+		return s.removeLocal(path)
 	}
-	exists, _ := FileExists(path)
-	if exists {
-		isSwapping = state
+	return nil
+}
+
+// removeLocal deletes path after it has been deleted in remote folder, files changed in source folder since last
+// synchronization are resolved with the conflict policy first and the ones which are kept are not deleted.
+func (s *Sync) removeLocal(path string) error {
+	files := make([]string, 0)
+	err := filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, filePath)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	deleted := make([]string, 0, len(files))
+	for _, file := range files {
+		proceed, err := s.checkDeleteConflict(file)
+		if err != nil {
+			return err
+		}
+		if proceed {
+			deleted = append(deleted, file)
+		}
+	}
+	logger.Info("Deleting local path '%s' ...", TruncatePath(path))
+	if len(deleted) < len(files) {
+		// some files are kept, their folders must stay
+		for _, file := range deleted {
+			err = os.Remove(file)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			s.state.Delete(s.TrimPath(file))
+		}
+		logger.Info("Finished deleting local path '%s', %d changed file(s) kept.", TruncatePath(path), len(files) - len(deleted))
+		return nil
+	}
+	err = os.RemoveAll(path)
+	if err != nil {
+		return err
+	}
+	s.state.Delete(s.TrimPath(path))
+	s.state.DeleteDir(s.TrimPath(path))
+	logger.Info("Finished deleting local path '%s'.", TruncatePath(path))
+	return nil
+}
+
+// uploadAll sends every file of source folder to containerFiler, it's used to synchronize an instance which joins.
+func (s *Sync) uploadAll(containerFiler ContainerFiler) error {
+	if s.dryRun {
+		containerFiler = NewContainerFilerDryRun(containerFiler)
+	}
+	files, err := s.listLocalFiles()
+	if err != nil {
+		return err
+	}
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	err = containerFiler.UploadFiles(s.sourceDir, s.targetDir, paths)
+	if err != nil {
+		return err
+	}
+	return s.uploadEmptyDirs(containerFiler)
+}
+
+// synced must be called after paths have been changed in remote folder or in source folder by the sync itself,
+// it records their state and prevents remote watcher to send back the change.
+func (s *Sync) synced(paths ...string) {
+	for _, path := range paths {
+		relPath := s.TrimPath(path)
+		remoteStat, err := s.containerFiler.Stat(s.ToRemotePath(path))
+		if err != nil {
+			remoteStat = nil
+		}
+		if s.remoteWatcher != nil {
+			s.remoteWatcher.Acknowledge(relPath, remoteStat)
+		}
+		localStat, err := os.Stat(path)
+		if remoteStat == nil || err != nil || remoteStat.IsDir() || localStat.IsDir() || s.isPreservedSymlink(path) {
+			s.state.Delete(relPath)
+			continue
+		}
+		fileState := NewFileState(localStat, remoteStat)
+		fileState.Hash, _ = HashFile(path)
+		s.state.Set(relPath, fileState)
+	}
+}
+
+// uploaded must be called after paths have been changed in remote folder, hooks matching them are run.
+func (s *Sync) uploaded(paths ...string) {
+	if s.hookRunner == nil {
 		return
 	}
-	tempPath := strings.TrimSuffix(path, ext)
-	return s.isSwappingWithLastState(tempPath + ext[:len(ext) - 1], true)
+	for _, path := range paths {
+		s.hookRunner.Notify(s.ToRemotePath(path))
+	}
+}
+
+// loadState records state of files which exist in both source folder and remote folder when sync starts,
+// state of files left in conflict is not recorded to find them again at next start.
+func (s *Sync) loadState() error {
+	remoteFiles, err := s.listRemoteFiles()
+	if err != nil {
+		return err
+	}
+	for path, remoteStat := range remoteFiles {
+		localStat, err := os.Stat(s.ToLocalPath(path))
+		if err != nil || localStat.IsDir() || s.unresolved[path] || isSymlink(remoteStat) || s.isPreservedSymlink(s.ToLocalPath(path)) {
+			s.state.Delete(path)
+			continue
+		}
+		fileState, ok := s.state.Get(path)
+		if ok && !fileState.LocalChanged(localStat) && !fileState.RemoteChanged(remoteStat) {
+			continue
+		}
+		s.state.Set(path, NewFileState(localStat, remoteStat))
+	}
+	for _, path := range s.state.Paths() {
+		if _, ok := remoteFiles[path]; !ok {
+			s.state.Delete(path)
+		}
+	}
+	return nil
+}
+func (s Sync) stateFile() string {
+	return filepath.Join(s.sourceDir, STATE_FILENAME)
+}
+
+// markEcho registers a local path changed by a remote event, local events received for this path (or its children)
+// will be ignored for a short delay to not send back the change to the container.
+func (s *Sync) markEcho(path string) {
+	s.echoesMutex.Lock()
+	defer s.echoesMutex.Unlock()
+	s.echoes[path] = time.Now().Add(LOCAL_ECHO_DELAY)
+}
+func (s *Sync) isEcho(path string) bool {
+	s.echoesMutex.Lock()
+	defer s.echoesMutex.Unlock()
+	now := time.Now()
+	for echoPath, until := range s.echoes {
+		if now.After(until) {
+			delete(s.echoes, echoPath)
+			continue
+		}
+		if path == echoPath || strings.HasPrefix(path, echoPath + string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
 }
 func (s Sync) TrimPath(path string) string {
 	path = strings.TrimPrefix(path, s.sourceDir)
@@ -241,4 +679,37 @@ func (s Sync) ToRemotePath(path string) string {
 }
 func (s *Sync) SetForceSync(forceSync bool) {
 	s.forceSync = forceSync
+}
+func (s *Sync) SetChecksum(checksum bool) {
+	s.checksum = checksum
+}
+func (s *Sync) SetPlanOnly(planOnly bool) {
+	s.planOnly = planOnly
+}
+func (s *Sync) SetSyncIgnore(syncIgnore *SyncIgnore) {
+	s.syncIgnore = syncIgnore
+}
+func (s *Sync) SetRemoteWatcher(remoteWatcher *RemoteWatcher) {
+	s.remoteWatcher = remoteWatcher
+}
+func (s *Sync) SetInstanceWatcher(instanceWatcher *InstanceWatcher) {
+	s.instanceWatcher = instanceWatcher
+}
+func (s *Sync) SetHookRunner(hookRunner *HookRunner) {
+	s.hookRunner = hookRunner
+}
+func (s *Sync) SetBuildHooks(buildHooks []BuildHook) {
+	s.buildHooks = buildHooks
+}
+func (s *Sync) SetConflictPolicy(conflictPolicy string) {
+	s.conflictPolicy = conflictPolicy
+}
+func (s *Sync) SetDebounce(debounce time.Duration) {
+	s.debounce = debounce
+}
+func (s *Sync) SetParallel(parallel int) {
+	s.parallel = parallel
+}
+func (s *Sync) SetDryRun(dryRun bool) {
+	s.dryRun = dryRun
 }
\ No newline at end of file
@@ -6,9 +6,9 @@ import (
 	"code.cloudfoundry.org/cli/plugin"
 	"encoding/json"
 	"errors"
+	"github.com/ArthurHlt/gominlog"
 	"gopkg.in/urfave/cli.v1"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 )
@@ -16,12 +16,21 @@ import (
 const (
 	DEFAULT_SYNC_FOLDER        = "sync"
 	DEFAULT_ROOT_TARGET_FOLDER = "app"
+	KEEPALIVE_INTERVAL         = 30 * time.Second
 )
 
 type SyncCommand struct {
 	cliConnection plugin.CliConnection
 }
 
+type SshTarget struct {
+	appName     string
+	app         models.Application
+	processGuid string
+	sshInfo     SshInfo
+	sslDisabled bool
+}
+
 type SshInfo struct {
 	AppSSHEndpoint           string `json:"app_ssh_endpoint"`
 	AppSSHHostKeyFingerprint string `json:"app_ssh_host_key_fingerprint"`
@@ -32,44 +41,116 @@ func (s SyncCommand) getSourceDir(c *cli.Context, appName string) (string, error
 	if sourceDir == "" {
 		sourceDir = "./" + DEFAULT_SYNC_FOLDER + "-" + appName
 	}
-	sourceDir, err := filepath.Abs(sourceDir)
-	if err != nil {
-		return "", err
+	return toSourceDir(sourceDir, c.Bool("dry-run"))
+}
+func (s SyncCommand) getTargetDir(c *cli.Context) string {
+	return toTargetDir(c.String("target"))
+}
+
+// getMappings gives folders to synchronize, from --map options, from --source and --target options
+// or from the configuration file.
+func (s SyncCommand) getMappings(c *cli.Context, appName string, config *Config) ([]Mapping, error) {
+	mappings := make([]Mapping, 0)
+	hasFlags := len(c.StringSlice("map")) > 0 || c.IsSet("source") || c.IsSet("target")
+	if !hasFlags && config != nil && len(config.Mappings) > 0 {
+		var err error
+		mappings, err = config.GetMappings(c.Bool("dry-run"))
+		if err != nil {
+			return nil, err
+		}
+	} else if len(c.StringSlice("map")) == 0 {
+		sourceDir, err := s.getSourceDir(c, appName)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, Mapping{SourceDir: sourceDir, TargetDir: s.getTargetDir(c)})
+	} else if c.IsSet("source") || c.IsSet("target") {
+		return nil, errors.New("--map can't be used with --source or --target.")
 	}
-	dirExists, err := FileExists(sourceDir)
+	for _, value := range c.StringSlice("map") {
+		local, remote, err := ParseMapping(value)
+		if err != nil {
+			return nil, err
+		}
+		sourceDir, err := toSourceDir(local, c.Bool("dry-run"))
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, Mapping{SourceDir: sourceDir, TargetDir: toTargetDir(remote)})
+	}
+	err := CheckMappings(mappings)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if !dirExists {
-		err = os.MkdirAll(sourceDir, 0755)
+	for i, mapping := range mappings {
+		if c.Bool("dry-run") {
+			mappings[i].SyncIgnore, err = NewDryRunSyncIgnore(mapping.SourceDir, mapping.TargetDir)
+		} else {
+			mappings[i].SyncIgnore, err = NewSyncIgnore(mapping.SourceDir, mapping.TargetDir)
+		}
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+		if config != nil {
+			err = mappings[i].SyncIgnore.AddPatterns(config.IgnorePatterns(mapping.TargetDir))
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
-	return sourceDir, nil
+	return mappings, nil
 }
-func (s SyncCommand) getTargetDir(c *cli.Context) string {
-	targetDir := c.String("target")
-	if targetDir == "" {
-		return DEFAULT_ROOT_TARGET_FOLDER
+func (s *SyncCommand) Sync(c *cli.Context) error {
+	if c.Bool("debug") {
+		logger.SetLevel(gominlog.Ldebug)
 	}
-	if !strings.HasPrefix(targetDir, "/") {
-		targetDir = "/" + targetDir
+	config, err := FindConfig()
+	if err != nil {
+		return err
 	}
-	return DEFAULT_ROOT_TARGET_FOLDER + targetDir
-}
-func (s *SyncCommand) Sync(c *cli.Context) error {
-	forceSync := c.Bool("force-sync")
 	appName := c.Args().First()
+	if config != nil {
+		logger.Info("Using configuration file '%s'.", TruncatePath(config.Path()))
+		err = config.Apply(c)
+		if err != nil {
+			return err
+		}
+		if appName == "" {
+			appName = config.App
+		}
+	}
+	forceSync := c.Bool("force-sync")
+	dryRun := c.Bool("dry-run")
 	if appName == "" {
 		return errors.New("You must pass an app name.")
 	}
-	sourceDir, err := s.getSourceDir(c, appName)
+	if c.Bool("all-instances") && c.IsSet("instance") {
+		return errors.New("--instance can't be used with --all-instances.")
+	}
+	if c.Int("instance") < 0 {
+		return errors.New("--instance must be a positive index.")
+	}
+	conflictPolicy := c.String("conflict")
+	err = CheckConflictPolicy(conflictPolicy)
+	if err != nil {
+		return err
+	}
+	err = CheckSymlinkMode(c.String("symlinks"))
+	if err != nil {
+		return err
+	}
+	_, err = ParseUmask(c.String("umask"))
 	if err != nil {
 		return err
 	}
-	targetDir := s.getTargetDir(c)
-	syncIgnore, err := NewSyncIgnore(sourceDir, targetDir)
+	if c.Int("max-delete") < 0 {
+		return errors.New("--max-delete must be positive, 0 means no limit.")
+	}
+	editors, err := ParseEditors(c.String("editors"))
+	if err != nil {
+		return err
+	}
+	mappings, err := s.getMappings(c, appName, config)
 	if err != nil {
 		return err
 	}
@@ -92,18 +173,9 @@ func (s *SyncCommand) Sync(c *cli.Context) error {
 		return err
 	}
 	logger.Info("Finished retrieving information about your app.\n")
-	logger.Info("Authenticating through UAA for ssh ...")
-	data, err = s.cliConnection.CliCommandWithoutTerminalOutput("ssh-code")
-	if err != nil {
-		return err
-	}
-	keepAliveInterval := 30 * time.Second
-	token := data[0]
-	secureShell := NewSecureShell(
-		DefaultSecureDialer(),
-		DefaultListenerFactory(),
-		keepAliveInterval,
-		models.Application{
+	sshTarget := SshTarget{
+		appName: appName,
+		app: models.Application{
 			ApplicationFields: models.ApplicationFields{
 				// guid can be found by doing cf app myapp --guid
 				GUID: app.Guid,
@@ -111,41 +183,211 @@ func (s *SyncCommand) Sync(c *cli.Context) error {
 				State: app.State,
 			},
 		},
+		sshInfo: sshInfo,
+		sslDisabled: sslDisabled,
+	}
+	processType := c.String("process")
+	instances := func() (map[int]time.Time, error) {
+		return s.getAppInstances(appName)
+	}
+	if processType != DEFAULT_PROCESS_TYPE {
+		sshTarget.processGuid, err = s.getProcessGuid(app.Guid, processType)
+		if err != nil {
+			return err
+		}
+		instances = func() (map[int]time.Time, error) {
+			return s.getProcessInstances(sshTarget.processGuid)
+		}
+	}
+	filers := make([]ContainerFiler, len(mappings))
+	// primaryClient gives the current client of the instance used to watch remote folder, with all instances
+	// it's the client of another instance when this one stops
+	var primaryClient func() *SecureClient
+	var instanceWatcher *InstanceWatcher
+	var hookClients func() map[int]*SecureClient
+	if c.Bool("all-instances") {
+		instanceWatcher = NewInstanceWatcher(processType, instances, func(index int) (*InstanceConnection, error) {
+			return s.connectInstance(c, sshTarget, mappings, index)
+		})
+		for i, mapping := range mappings {
+			filers[i] = instanceWatcher.AddMapping(mapping)
+		}
+		_, err := instanceWatcher.ConnectFirst()
+		if err != nil {
+			return err
+		}
+		defer instanceWatcher.Stop()
+		go instanceWatcher.Watch()
+		primaryClient = instanceWatcher.PrimaryClient
+		hookClients = instanceWatcher.Clients
+	} else {
+		index := c.Int("instance")
+		running, err := instances()
+		if err != nil {
+			return err
+		}
+		err = CheckInstanceRunning(index, processType, running)
+		if err != nil {
+			return err
+		}
+		connection, err := s.connectInstance(c, sshTarget, mappings, index)
+		if err != nil {
+			return err
+		}
+		defer connection.Close()
+		for i, mapping := range mappings {
+			containerFiler := connection.ContainerFiler(mapping)
+			containerFiler.SetWriter(os.Stdout)
+			filers[i] = containerFiler
+		}
+		primaryClient = connection.supervisor.Client
+		hookClients = func() map[int]*SecureClient {
+			return map[int]*SecureClient{index: connection.supervisor.Client()}
+		}
+	}
+	if dryRun {
+		logger.Warning("Dry-run mode: nothing will be changed in container or in source folder.")
+	}
+	var hookRunner *HookRunner
+	if config != nil && len(config.Hooks) > 0 {
+		// hooks are shared by all mappings to run them once when several mappings change
+		hookRunner = NewHookRunner(config.RemoteHooks(), hookClients)
+		hookRunner.SetDryRun(dryRun)
+	}
+	syncs := make([]*Sync, len(mappings))
+	for i, mapping := range mappings {
+		filer := filers[i]
+		if dryRun {
+			filer = NewContainerFilerDryRun(filer)
+		}
+		sync, err := NewSync(filer, mapping.SourceDir, mapping.TargetDir)
+		if err != nil {
+			return err
+		}
+		sync.SetForceSync(forceSync)
+		sync.SetChecksum(c.Bool("checksum"))
+		sync.SetPlanOnly(c.Bool("plan"))
+		sync.SetSyncIgnore(mapping.SyncIgnore)
+		sync.SetConflictPolicy(conflictPolicy)
+		sync.SetDebounce(c.Duration("debounce"))
+		sync.SetParallel(c.Int("parallel"))
+		sync.SetDryRun(dryRun)
+		sync.SetSymlinks(c.String("symlinks"))
+		sync.SetEditors(editors)
+		if instanceWatcher != nil {
+			sync.SetInstanceWatcher(instanceWatcher)
+		}
+		if hookRunner != nil {
+			sync.SetHookRunner(hookRunner)
+		}
+		if config != nil {
+			sync.SetBuildHooks(config.GetBuildHooks())
+		}
+		if c.Bool("bidirectional") {
+			sync.SetRemoteWatcher(NewRemoteWatcher(
+				filer,
+				primaryClient,
+				mapping.SyncIgnore,
+				mapping.TargetDir,
+				c.Duration("poll-interval"),
+			))
+		}
+		syncs[i] = sync
+	}
+	if len(syncs) == 1 {
+		return syncs[0].Run()
+	}
+	// each mapping is synchronized independently, sync stops when one of them fails
+	errCh := make(chan error, len(syncs))
+	for _, sync := range syncs {
+		go func(sync *Sync) {
+			errCh <- sync.Run()
+		}(sync)
+	}
+	for range syncs {
+		err := <-errCh
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connectInstance opens a supervised ssh connection to the instance index of the app, shared by all mappings.
+func (s *SyncCommand) connectInstance(c *cli.Context, sshTarget SshTarget, mappings []Mapping, index int) (*InstanceConnection, error) {
+	logger.Info("Authenticating through UAA for ssh ...")
+	token, err := s.sshCode()
+	if err != nil {
+		return nil, err
+	}
+	secureShell := NewSecureShell(
+		DefaultSecureDialer(),
+		DefaultListenerFactory(),
+		KEEPALIVE_INTERVAL,
+		sshTarget.app,
 		// this is a signature for ssh, it can be found when doing cf curl /v2/info
-		sshInfo.AppSSHHostKeyFingerprint,
+		sshTarget.sshInfo.AppSSHHostKeyFingerprint,
 		// endpoint to connect in ssh, it can be found when doing cf curl /v2/info
-		sshInfo.AppSSHEndpoint,
+		sshTarget.sshInfo.AppSSHEndpoint,
 		// token retrieve when doing cf ssh-code
 		token,
 	)
+	if sshTarget.processGuid != "" {
+		secureShell.SetProcessGUID(sshTarget.processGuid)
+	}
 	err = secureShell.Connect(&options.SSHOptions{
-		AppName:             appName,
-		SkipHostValidation:  sslDisabled,
+		AppName:             sshTarget.appName,
+		SkipHostValidation:  sshTarget.sslDisabled,
 		SkipRemoteExecution: true,
 		Command:             []string{},
-		Index:               uint(0),
+		Index:               uint(index),
 		ForwardSpecs:        []options.ForwardSpec{},
 		TerminalRequest:     options.RequestTTYAuto,
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer secureShell.Close()
 	logger.Info("Finished authenticating for ssh.")
-	keepaliveStopCh := make(chan struct{})
-	defer close(keepaliveStopCh)
+	supervisor := NewConnectionSupervisor(secureShell, s.sshCode, KEEPALIVE_INTERVAL)
+	go supervisor.Watch()
 
-	go keepalive(secureShell.secureClient.Conn(), time.NewTicker(keepAliveInterval), keepaliveStopCh)
-
-	containerFiler, err := NewContainerFiler(secureShell.secureClient, syncIgnore)
+	containerFiler, err := NewContainerFiler(secureShell.secureClient, mappings[0].SyncIgnore)
 	if err != nil {
-		return err
+		supervisor.Stop()
+		secureShell.Close()
+		return nil, err
 	}
-	containerFiler.SetWriter(os.Stdout)
-	sync, err := NewSync(containerFiler, sourceDir, targetDir)
+	containerFiler.SetDelta(c.Bool("delta"))
+	containerFiler.SetBulk(c.Bool("tar"), c.Bool("compress"))
+	containerFiler.SetSymlinks(c.String("symlinks"))
+	umask, _ := ParseUmask(c.String("umask"))
+	containerFiler.SetUmask(umask)
+	containerFiler.SetMaxDelete(c.Int("max-delete"))
+	for _, mapping := range mappings {
+		if c.Bool("dry-run") {
+			break
+		}
+		err = containerFiler.withSyncIgnore(mapping.SyncIgnore).CleanTempFiles(mapping.TargetDir)
+		if err != nil {
+			logger.Warning("Temporary files of previous session can't be cleaned: " + err.Error())
+		}
+	}
+	return &InstanceConnection{
+		index: index,
+		secureShell: secureShell,
+		supervisor: supervisor,
+		containerFiler: containerFiler,
+	}, nil
+}
+
+// sshCode gets a one-time code to authenticate through ssh.
+func (s *SyncCommand) sshCode() (string, error) {
+	data, err := s.cliConnection.CliCommandWithoutTerminalOutput("ssh-code")
 	if err != nil {
-		return err
+		return "", err
+	}
+	if len(data) == 0 {
+		return "", errors.New("No one-time code received from ssh-code.")
 	}
-	sync.SetForceSync(forceSync)
-	return sync.Run()
+	return data[0], nil
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	CONFLICT_LOCAL_WINS  = "local-wins"
+	CONFLICT_REMOTE_WINS = "remote-wins"
+	CONFLICT_KEEP_BOTH   = "keep-both"
+	CONFLICT_ASK         = "ask"
+	CONFLICT_EXT         = ".conflict"
+)
+
+var conflictPolicies []string = []string{CONFLICT_LOCAL_WINS, CONFLICT_REMOTE_WINS, CONFLICT_KEEP_BOTH, CONFLICT_ASK}
+
+var askMutex *sync.Mutex = &sync.Mutex{}
+
+// stdinReader is shared by syncs of all mappings, answers already buffered would be lost with a reader per question.
+var stdinReader *bufio.Reader = bufio.NewReader(os.Stdin)
+
+func CheckConflictPolicy(policy string) error {
+	for _, conflictPolicy := range conflictPolicies {
+		if policy == conflictPolicy {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid conflict policy '%s', valid policies are: %s.", policy, strings.Join(conflictPolicies, ", "))
+}
+
+// checkUploadConflict must be called before uploading a file, it returns false when the remote file must not be overwritten.
+func (s *Sync) checkUploadConflict(path string, localStat os.FileInfo) (bool, error) {
+	remoteStat, err := s.containerFiler.Stat(s.ToRemotePath(path))
+	if err != nil {
+		// remote file doesn't exist (anymore), nothing can be overwritten
+		return true, nil
+	}
+	if remoteStat.IsDir() {
+		return true, nil
+	}
+	fileState, ok := s.state.Get(s.TrimPath(path))
+	if ok && !fileState.RemoteChanged(remoteStat) {
+		return true, nil
+	}
+	policy, err := s.resolveConflict(path, localStat, remoteStat)
+	if err != nil {
+		return false, err
+	}
+	switch policy {
+	case CONFLICT_REMOTE_WINS:
+		return false, s.download(s.ToRemotePath(path), path, false)
+	case CONFLICT_KEEP_BOTH:
+		return true, s.keepRemoteCopy(path)
+	}
+	return true, nil
+}
+
+// checkDownloadConflict must be called before downloading a file, it returns false when the local file must not be overwritten.
+func (s *Sync) checkDownloadConflict(path string, remoteStat os.FileInfo) (bool, error) {
+	localStat, err := os.Stat(path)
+	if err != nil || localStat.IsDir() {
+		return true, nil
+	}
+	fileState, ok := s.state.Get(s.TrimPath(path))
+	if ok && !fileState.LocalChanged(localStat) {
+		return true, nil
+	}
+	policy, err := s.resolveConflict(path, localStat, remoteStat)
+	if err != nil {
+		return false, err
+	}
+	switch policy {
+	case CONFLICT_LOCAL_WINS:
+		return false, s.upload(path, false)
+	case CONFLICT_KEEP_BOTH:
+		err = s.keepRemoteCopy(path)
+		if err != nil {
+			return false, err
+		}
+		return false, s.upload(path, false)
+	}
+	return true, nil
+}
+
+// checkDeleteConflict must be called before deleting a local file removed in remote folder, it returns false when
+// the local file must not be deleted because it has changed since last synchronization, it's then sent again
+// unless the conflict is resolved with remote-wins.
+func (s *Sync) checkDeleteConflict(path string) (bool, error) {
+	// symlinks are only links, what they point to is not deleted
+	localStat, err := os.Lstat(path)
+	if err != nil || localStat.IsDir() || isSymlink(localStat) {
+		return true, nil
+	}
+	fileState, ok := s.state.Get(s.TrimPath(path))
+	if ok && !fileState.LocalChanged(localStat) {
+		return true, nil
+	}
+	logger.Warning("Conflict on file '%s', it has been deleted in remote folder and changed in source folder since last synchronization.", TruncatePath(path))
+	deleteLocal := s.conflictPolicy == CONFLICT_REMOTE_WINS
+	if s.conflictPolicy == CONFLICT_ASK {
+		deleteLocal, err = s.askConfirmation(fmt.Sprintf("Delete local file '%s' too?", TruncatePath(path)))
+		if err != nil {
+			return false, err
+		}
+	}
+	if deleteLocal {
+		logger.Warning("Conflict on file '%s' resolved: local version is deleted.", TruncatePath(path))
+		return true, nil
+	}
+	logger.Warning("Conflict on file '%s' resolved: local version is kept and sent again.", TruncatePath(path))
+	return false, s.upload(path, false)
+}
+func (s *Sync) resolveConflict(path string, localStat, remoteStat os.FileInfo) (string, error) {
+	logger.Warning("Conflict on file '%s', it has changed in source folder and in remote folder since last synchronization:", TruncatePath(path))
+	logger.Warning("  local version:  %d bytes, modified at %s", localStat.Size(), localStat.ModTime().Format("2006-01-02 15:04:05"))
+	logger.Warning("  remote version: %d bytes, modified at %s", remoteStat.Size(), remoteStat.ModTime().Format("2006-01-02 15:04:05"))
+	policy := s.conflictPolicy
+	if policy == CONFLICT_ASK {
+		var err error
+		policy, err = s.askConflict(path)
+		if err != nil {
+			return "", err
+		}
+	}
+	switch policy {
+	case CONFLICT_REMOTE_WINS:
+		logger.Warning("Conflict on file '%s' resolved with '%s': local version is replaced by remote version.", TruncatePath(path), policy)
+	case CONFLICT_KEEP_BOTH:
+		logger.Warning("Conflict on file '%s' resolved with '%s': remote version is kept in '%s', local version is sent.",
+			TruncatePath(path), policy, TruncatePath(path + CONFLICT_EXT))
+	default:
+		logger.Warning("Conflict on file '%s' resolved with '%s': remote version is replaced by local version.", TruncatePath(path), policy)
+	}
+	return policy, nil
+}
+func (s *Sync) askConflict(path string) (string, error) {
+	askMutex.Lock()
+	defer askMutex.Unlock()
+	for {
+		fmt.Printf("Keep [l]ocal version, [r]emote version or [b]oth versions of '%s'? ", TruncatePath(path))
+		answer, err := s.stdin.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "l", "local":
+			return CONFLICT_LOCAL_WINS, nil
+		case "r", "remote":
+			return CONFLICT_REMOTE_WINS, nil
+		case "b", "both":
+			return CONFLICT_KEEP_BOTH, nil
+		}
+	}
+}
+
+// askConfirmation asks a yes/no question, anything but yes is a no.
+func (s *Sync) askConfirmation(question string) (bool, error) {
+	askMutex.Lock()
+	defer askMutex.Unlock()
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := s.stdin.ReadString('\n')
+	if err != nil && answer == "" {
+		return false, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
+func (s *Sync) keepRemoteCopy(path string) error {
+	conflictPath := path + CONFLICT_EXT
+	s.markEcho(conflictPath)
+	return s.containerFiler.Download(s.ToRemotePath(path), conflictPath)
+}
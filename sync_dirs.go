@@ -0,0 +1,224 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// syncEmptyDirs restores empty folders missing on one side, empty folders are not seen when files are compared.
+func (s *Sync) syncEmptyDirs() error {
+	err := s.restoreLocalDirs()
+	if err != nil {
+		return err
+	}
+	err = s.trackEmptyDirs()
+	if err != nil {
+		return err
+	}
+	return s.uploadEmptyDirs(s.containerFiler)
+}
+
+// listEmptyDirs gives folders of source folder which contain nothing synchronized, by path relative to source folder.
+func (s Sync) listEmptyDirs() (map[string]os.FileInfo, error) {
+	dirs := make(map[string]os.FileInfo)
+	nonEmpty := make(map[string]bool)
+	err := s.walkLocal(s.sourceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == s.sourceDir {
+			return nil
+		}
+		if s.syncIgnore != nil && s.syncIgnore.Match(s.ToRemotePath(path), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if s.isIgnored(path) {
+			return nil
+		}
+		nonEmpty[filepath.Dir(path)] = true
+		if info.IsDir() {
+			dirs[path] = info
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	emptyDirs := make(map[string]os.FileInfo)
+	for path, info := range dirs {
+		if !nonEmpty[path] {
+			emptyDirs[s.TrimPath(path)] = info
+		}
+	}
+	return emptyDirs, nil
+}
+
+// restoreLocalDirs recreates empty folders recorded in state which are missing in source folder but still exist
+// in remote folder, folders missing on both sides are forgotten.
+func (s *Sync) restoreLocalDirs() error {
+	for path, permissions := range s.state.Dirs() {
+		localPath := s.ToLocalPath(path)
+		exists, err := FileExists(localPath)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		remoteStat, err := s.containerFiler.Stat(s.ToRemotePath(path))
+		if err != nil || !remoteStat.IsDir() {
+			s.state.DeleteDir(path)
+			continue
+		}
+		if s.dryRun {
+			logger.Info("[dry-run] Would restore empty folder '%s' with permissions %s.", TruncatePath(localPath), permissions.String())
+			continue
+		}
+		err = os.MkdirAll(localPath, 0755)
+		if err == nil {
+			err = os.Chmod(localPath, permissions)
+		}
+		if err != nil {
+			return err
+		}
+		logger.Info("Empty folder '%s' restored with permissions %s.", TruncatePath(localPath), permissions.String())
+	}
+	return nil
+}
+
+// trackEmptyDirs records permissions of empty folders of source folder, folders which are no longer empty are forgotten.
+func (s *Sync) trackEmptyDirs() error {
+	emptyDirs, err := s.listEmptyDirs()
+	if err != nil {
+		return err
+	}
+	for path := range s.state.Dirs() {
+		if _, ok := emptyDirs[path]; !ok {
+			s.state.DeleteDir(path)
+		}
+	}
+	for path, info := range emptyDirs {
+		s.state.SetDir(path, info.Mode().Perm())
+	}
+	return nil
+}
+
+// uploadEmptyDirs creates in containerFiler empty folders recorded in state which don't exist in remote folder.
+func (s *Sync) uploadEmptyDirs(containerFiler ContainerFiler) error {
+	dirs := s.state.Dirs()
+	paths := make([]string, 0, len(dirs))
+	for path := range dirs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		remotePath := s.ToRemotePath(path)
+		if _, err := containerFiler.Stat(remotePath); err == nil {
+			continue
+		}
+		err := containerFiler.MakeDir(remotePath, dirs[path])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadFolder sends a folder of source folder with all its content, it's used when a folder is moved
+// in source folder or when a symlink to a folder is followed.
+func (s *Sync) uploadFolder(path string) error {
+	paths := make([]string, 0)
+	dirs := make(map[string]os.FileInfo)
+	nonEmpty := make(map[string]bool)
+	err := s.walkLocal(path, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if s.syncIgnore != nil && s.syncIgnore.Match(s.ToRemotePath(filePath), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if s.isIgnored(filePath) {
+			return nil
+		}
+		nonEmpty[filepath.Dir(filePath)] = true
+		if info.IsDir() {
+			dirs[filePath] = info
+			return nil
+		}
+		paths = append(paths, s.TrimPath(filePath))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("Uploading folder '%s' with %d file(s) ...", TruncatePath(path), len(paths))
+	if len(paths) > 0 {
+		err = s.containerFiler.UploadFiles(s.sourceDir, s.targetDir, paths)
+		if err != nil {
+			return err
+		}
+	}
+	dirPaths := make([]string, 0, len(dirs))
+	for dirPath := range dirs {
+		dirPaths = append(dirPaths, dirPath)
+	}
+	sort.Strings(dirPaths)
+	for _, dirPath := range dirPaths {
+		// folders with content have been created by upload of their files
+		if nonEmpty[dirPath] && dirPath != path {
+			continue
+		}
+		err = s.containerFiler.MakeDir(s.ToRemotePath(dirPath), dirs[dirPath].Mode())
+		if err != nil {
+			return err
+		}
+		if !nonEmpty[dirPath] {
+			s.state.SetDir(s.TrimPath(dirPath), dirs[dirPath].Mode().Perm())
+		}
+	}
+	for _, relPath := range paths {
+		s.synced(s.ToLocalPath(relPath))
+		s.uploaded(relPath)
+	}
+	logger.Info("Finished uploading folder '%s'.", TruncatePath(path))
+	return nil
+}
+
+// downloadFolder writes in path every file of remotePath, it's used when a folder is moved in remote folder.
+func (s *Sync) downloadFolder(path, remotePath string) error {
+	files, err := s.containerFiler.ListRemoteFiles(remotePath)
+	if err != nil {
+		return err
+	}
+	relDir := s.TrimPath(path)
+	paths := make([]string, 0, len(files))
+	for file := range files {
+		if !s.isIgnored(s.ToLocalPath(relDir + "/" + file)) {
+			paths = append(paths, relDir + "/" + file)
+		}
+	}
+	sort.Strings(paths)
+	logger.Info("Downloading folder '%s' with %d file(s) ...", TruncatePath(remotePath), len(paths))
+	if len(paths) == 0 {
+		return nil
+	}
+	for _, relPath := range paths {
+		s.markEcho(s.ToLocalPath(relPath))
+	}
+	err = s.containerFiler.DownloadFiles(s.sourceDir, s.targetDir, paths)
+	if err != nil {
+		return err
+	}
+	for _, relPath := range paths {
+		s.synced(s.ToLocalPath(relPath))
+	}
+	logger.Info("Finished downloading folder '%s'.", TruncatePath(remotePath))
+	return nil
+}
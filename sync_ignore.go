@@ -2,8 +2,10 @@ package main
 
 import (
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"io/ioutil"
 	"github.com/monochromegane/go-gitignore"
 )
@@ -13,13 +15,27 @@ const IGNORE_FILENAME = ".syncignore"
 type SyncIgnore struct {
 	rootDir       string
 	base          string
+	dryRun        bool
+	patterns      []string
+	content       string
 	ignoreMatcher gitignore.IgnoreMatcher
+	mutex         *sync.RWMutex
 }
 
 func NewSyncIgnore(rootDir, base string) (*SyncIgnore, error) {
+	return newSyncIgnore(rootDir, base, false)
+}
+
+// NewDryRunSyncIgnore creates a SyncIgnore which never copies ignore file from working directory to root dir.
+func NewDryRunSyncIgnore(rootDir, base string) (*SyncIgnore, error) {
+	return newSyncIgnore(rootDir, base, true)
+}
+func newSyncIgnore(rootDir, base string, dryRun bool) (*SyncIgnore, error) {
 	syncIgnore := &SyncIgnore{
 		rootDir: rootDir,
 		base: base,
+		dryRun: dryRun,
+		mutex: &sync.RWMutex{},
 	}
 	err := syncIgnore.Load()
 	if err != nil {
@@ -27,7 +43,7 @@ func NewSyncIgnore(rootDir, base string) (*SyncIgnore, error) {
 	}
 	return syncIgnore, nil
 }
-func (i SyncIgnore) getFile() (*os.File, error) {
+func (i *SyncIgnore) getFile() (*os.File, error) {
 	rootDir, err := filepath.Abs(i.rootDir)
 	if err != nil {
 		return nil, err
@@ -50,6 +66,10 @@ func (i SyncIgnore) getFile() (*os.File, error) {
 	if !exists {
 		return nil, nil
 	}
+	if i.dryRun {
+		logger.Info("[dry-run] Would copy '%s' to '%s'.", IGNORE_FILENAME, TruncatePath(pathIgnoreFile))
+		return os.Open(IGNORE_FILENAME)
+	}
 	f, err := os.Create(pathIgnoreFile)
 	if err != nil {
 		return nil, err
@@ -71,16 +91,96 @@ func (i *SyncIgnore) Load() error {
 	if err != nil {
 		return err
 	}
-	if f == nil {
-		return nil
+	content := ""
+	if f != nil {
+		defer f.Close()
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		content = string(b)
 	}
-	defer f.Close()
-	i.ignoreMatcher = gitignore.NewGitIgnoreFromReader(i.base, f)
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.setContent(content)
 	return nil
 }
-func (i SyncIgnore) Match(pathfile string, isDir bool) bool {
+
+// Reload reads again the ignore file of root dir, it's never copied from working directory during a session.
+// previous keeps the rules used before, changed is false when the ignore file has not changed.
+func (i *SyncIgnore) Reload() (previous *SyncIgnore, changed bool, err error) {
+	b, err := ioutil.ReadFile(i.Path())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, err
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if string(b) == i.content {
+		return nil, false, nil
+	}
+	previous = &SyncIgnore{
+		rootDir: i.rootDir,
+		base: i.base,
+		patterns: i.patterns,
+		content: i.content,
+		ignoreMatcher: i.ignoreMatcher,
+		mutex: &sync.RWMutex{},
+	}
+	i.setContent(string(b))
+	return previous, true, nil
+}
+
+// setContent builds the matcher from the content of ignore file and patterns of configuration file, mutex must be held.
+func (i *SyncIgnore) setContent(content string) {
+	i.content = content
+	if content == "" && len(i.patterns) == 0 {
+		i.ignoreMatcher = nil
+		return
+	}
+	// patterns given in configuration file are appended to those of ignore file
+	content += "\n" + strings.Join(i.patterns, "\n")
+	i.ignoreMatcher = gitignore.NewGitIgnoreFromReader(i.base, strings.NewReader(content))
+}
+
+// Path gives the path of the ignore file in root dir.
+func (i *SyncIgnore) Path() string {
+	return filepath.Join(i.rootDir, IGNORE_FILENAME)
+}
+
+// AddPatterns adds ignore patterns to those of ignore file.
+func (i *SyncIgnore) AddPatterns(patterns []string) error {
+	if len(patterns) == 0 {
+		return nil
+	}
+	i.patterns = append(i.patterns, patterns...)
+	return i.Load()
+}
+func (i *SyncIgnore) Match(pathfile string, isDir bool) bool {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
 	if i.ignoreMatcher == nil {
 		return false
 	}
 	return i.ignoreMatcher.Match(pathfile, isDir)
-}
\ No newline at end of file
+}
+
+// MatchParents tells if pathfile or one of its parent folders, below base, is ignored.
+func (i *SyncIgnore) MatchParents(pathfile string, isDir bool) bool {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	if i.ignoreMatcher == nil {
+		return false
+	}
+	if i.ignoreMatcher.Match(pathfile, isDir) {
+		return true
+	}
+	base := strings.TrimSuffix(filepath.ToSlash(i.base), "/")
+	parent := path.Dir(filepath.ToSlash(pathfile))
+	for strings.HasPrefix(parent, base + "/") {
+		if i.ignoreMatcher.Match(parent, true) {
+			return true
+		}
+		parent = path.Dir(parent)
+	}
+	return false
+}
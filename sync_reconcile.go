@@ -0,0 +1,535 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rjeczalik/notify"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type SyncPlan struct {
+	Downloads     []string
+	Uploads       []string
+	LocalDeletes  []string
+	RemoteDeletes []string
+	Conflicts     []string
+	// conflicts are resolved with the conflict policy when it is known which side has changed
+	resolveConflicts bool
+	// knownFiles is the number of files recorded in state, missingFiles those of them missing in remote folder
+	knownFiles   int
+	missingFiles int
+}
+
+func (p SyncPlan) IsEmpty() bool {
+	return len(p.Downloads) == 0 && len(p.Uploads) == 0 && len(p.LocalDeletes) == 0 &&
+		len(p.RemoteDeletes) == 0 && len(p.Conflicts) == 0
+}
+func (p SyncPlan) Print() {
+	if p.IsEmpty() {
+		logger.Info("Source folder and remote folder are already synchronized.")
+		return
+	}
+	for _, path := range p.Downloads {
+		logger.Info("[download] '%s' is new or has changed in remote folder.", path)
+	}
+	for _, path := range p.Uploads {
+		logger.Info("[upload] '%s' is new or has changed in source folder.", path)
+	}
+	for _, path := range p.LocalDeletes {
+		logger.Info("[delete local] '%s' has been deleted in remote folder.", path)
+	}
+	for _, path := range p.RemoteDeletes {
+		logger.Info("[delete remote] '%s' has been deleted in source folder.", path)
+	}
+	for _, path := range p.Conflicts {
+		logger.Warning("[conflict] '%s' differs between source folder and remote folder.", path)
+	}
+	logger.Info("Plan: %d file(s) to download, %d file(s) to upload, %d file(s) to delete, %d file(s) in conflict.",
+		len(p.Downloads), len(p.Uploads), len(p.LocalDeletes) + len(p.RemoteDeletes), len(p.Conflicts))
+}
+
+// Only gives the part of the plan about paths for which keep returns true.
+func (p SyncPlan) Only(keep func(path string) bool) SyncPlan {
+	filter := func(paths []string) []string {
+		kept := make([]string, 0)
+		for _, path := range paths {
+			if keep(path) {
+				kept = append(kept, path)
+			}
+		}
+		return kept
+	}
+	return SyncPlan{
+		Downloads: filter(p.Downloads),
+		Uploads: filter(p.Uploads),
+		LocalDeletes: filter(p.LocalDeletes),
+		RemoteDeletes: filter(p.RemoteDeletes),
+		Conflicts: filter(p.Conflicts),
+		resolveConflicts: p.resolveConflicts,
+	}
+}
+
+func (s *Sync) reconcile() error {
+	logger.Info("Comparing folder '%s' with the remote folder '%s' ...", TruncatePath(s.sourceDir), TruncatePath(s.targetDir))
+	plan, err := s.buildPlan()
+	if err != nil {
+		return err
+	}
+	plan.Print()
+	if s.planOnly || plan.IsEmpty() {
+		return nil
+	}
+	if plan.isRemoteReset() {
+		plan = s.uploadBiasedPlan(plan)
+		plan.Print()
+	}
+	plan, err = s.confirmLocalChanges(plan)
+	if err != nil {
+		return err
+	}
+	err = s.applyPlan(plan)
+	if err != nil {
+		return err
+	}
+	logger.Info("Reconciliation finished.\n")
+	return nil
+}
+
+// reloadIgnoreEvent is dispatched after an event on the ignore file, it's a barrier for the dispatcher.
+type reloadIgnoreEvent struct {
+	path string
+}
+
+func (e reloadIgnoreEvent) Event() notify.Event {
+	return notify.Rename
+}
+func (e reloadIgnoreEvent) Path() string {
+	return e.path
+}
+func (e reloadIgnoreEvent) Sys() interface{} {
+	return nil
+}
+
+// reloadSyncIgnore applies the new rules of a changed ignore file: newly ignored paths are no longer synchronized
+// and synchronizing paths which are no longer ignored is offered. Rules are not reloaded while an editor is saving
+// the ignore file, they are when the save is finished.
+func (s *Sync) reloadSyncIgnore() error {
+	if s.isSaving(s.syncIgnore.Path()) {
+		return nil
+	}
+	previous, changed, err := s.syncIgnore.Reload()
+	if err != nil || !changed {
+		return err
+	}
+	logger.Info("Ignore file '%s' has changed, ignore rules have been reloaded.", TruncatePath(s.syncIgnore.Path()))
+	for _, path := range s.state.Paths() {
+		if s.syncIgnore.MatchParents(s.ToRemotePath(path), false) {
+			s.state.Delete(path)
+		}
+	}
+	plan, err := s.buildPlan()
+	if err != nil {
+		return err
+	}
+	plan = plan.Only(func(path string) bool {
+		return previous.MatchParents(s.ToRemotePath(path), false)
+	})
+	if plan.IsEmpty() {
+		return nil
+	}
+	logger.Info("Files which are no longer ignored differ between source folder and remote folder:")
+	plan.Print()
+	confirmed := true
+	if s.dryRun {
+		logger.Info("[dry-run] Would ask to synchronize files which are no longer ignored.")
+	} else {
+		confirmed, err = s.askConfirmation("Synchronize files which are no longer ignored?")
+		if err != nil {
+			return err
+		}
+	}
+	if !confirmed {
+		logger.Info("Files which are no longer ignored will be synchronized when they change.")
+		return nil
+	}
+	// conflicts are only resolved when asked for each of them, a change of ignore rules must not overwrite files
+	plan.resolveConflicts = s.conflictPolicy == CONFLICT_ASK
+	for _, path := range append(plan.Downloads, plan.Conflicts...) {
+		s.markEcho(s.ToLocalPath(path))
+	}
+	err = s.applyPlan(plan)
+	if err != nil {
+		return err
+	}
+	for _, path := range append(plan.Downloads, plan.Uploads...) {
+		if s.unresolved[path] {
+			continue
+		}
+		s.markEcho(s.ToLocalPath(path))
+		s.synced(s.ToLocalPath(path))
+	}
+	logger.Info("Reconciliation finished.")
+	return nil
+}
+func (s *Sync) buildPlan() (SyncPlan, error) {
+	localFiles, err := s.listLocalFiles()
+	if err != nil {
+		return SyncPlan{}, err
+	}
+	remoteFiles, err := s.listRemoteFiles()
+	if err != nil {
+		return SyncPlan{}, err
+	}
+	var plan SyncPlan
+	if s.state.IsEmpty() {
+		plan, err = s.buildPlanWithoutState(localFiles, remoteFiles)
+	} else {
+		plan, err = s.buildPlanWithState(localFiles, remoteFiles)
+	}
+	sort.Strings(plan.Downloads)
+	sort.Strings(plan.Uploads)
+	sort.Strings(plan.LocalDeletes)
+	sort.Strings(plan.RemoteDeletes)
+	sort.Strings(plan.Conflicts)
+	return plan, err
+}
+
+// buildPlanWithoutState copies files which exist on only one side and flags files which differ.
+func (s *Sync) buildPlanWithoutState(localFiles, remoteFiles map[string]os.FileInfo) (SyncPlan, error) {
+	plan := SyncPlan{}
+	for path, remoteStat := range remoteFiles {
+		localStat, ok := localFiles[path]
+		if !ok {
+			plan.Downloads = append(plan.Downloads, path)
+			continue
+		}
+		same, err := s.isSameFile(path, localStat, remoteStat)
+		if err != nil {
+			return plan, err
+		}
+		if !same {
+			plan.Conflicts = append(plan.Conflicts, path)
+		}
+	}
+	for path := range localFiles {
+		if _, ok := remoteFiles[path]; !ok {
+			plan.Uploads = append(plan.Uploads, path)
+		}
+	}
+	return plan, nil
+}
+
+// buildPlanWithState uses state of last session to find on which side each file has changed while sync was stopped.
+func (s *Sync) buildPlanWithState(localFiles, remoteFiles map[string]os.FileInfo) (SyncPlan, error) {
+	plan := SyncPlan{resolveConflicts: true}
+	paths := make(map[string]bool)
+	for path := range localFiles {
+		paths[path] = true
+	}
+	for path := range remoteFiles {
+		paths[path] = true
+	}
+	for _, path := range s.state.Paths() {
+		paths[path] = true
+	}
+	for path := range paths {
+		localStat, localExists := localFiles[path]
+		remoteStat, remoteExists := remoteFiles[path]
+		fileState, known := s.state.Get(path)
+		if known {
+			plan.knownFiles++
+			if !remoteExists {
+				plan.missingFiles++
+			}
+		}
+		localChanged, err := s.localChangedSince(path, localStat, fileState, known)
+		if err != nil {
+			return plan, err
+		}
+		remoteChanged := (!known && remoteExists) || (known && (!remoteExists || fileState.RemoteChanged(remoteStat)))
+		switch {
+		case !localChanged && !remoteChanged:
+		case !localExists && !remoteExists:
+			s.state.Delete(path)
+		case localChanged && !remoteChanged && localExists:
+			plan.Uploads = append(plan.Uploads, path)
+		case localChanged && !remoteChanged:
+			plan.RemoteDeletes = append(plan.RemoteDeletes, path)
+		case remoteChanged && !localChanged && remoteExists:
+			plan.Downloads = append(plan.Downloads, path)
+		case remoteChanged && !localChanged:
+			plan.LocalDeletes = append(plan.LocalDeletes, path)
+		case !localExists:
+			// deleted in source folder but modified in remote folder, modification is kept
+			plan.Downloads = append(plan.Downloads, path)
+		case !remoteExists:
+			// deleted in remote folder but modified in source folder, modification is kept
+			plan.Uploads = append(plan.Uploads, path)
+		default:
+			same, err := s.isSameFile(path, localStat, remoteStat)
+			if err != nil {
+				return plan, err
+			}
+			if !same {
+				plan.Conflicts = append(plan.Conflicts, path)
+			}
+		}
+	}
+	return plan, nil
+}
+// isRemoteReset tells if most files recorded in state are missing in remote folder, it happens when the container
+// has been restarted from the droplet: changes sent during last session are lost and must not be taken as remote changes.
+func (p SyncPlan) isRemoteReset() bool {
+	return p.knownFiles > 0 && p.missingFiles * 2 > p.knownFiles
+}
+
+// uploadBiasedPlan sends local versions instead of deleting or overwriting local files, only files which don't
+// exist in source folder are still downloaded.
+func (s *Sync) uploadBiasedPlan(plan SyncPlan) SyncPlan {
+	logger.Warning("%d of %d file(s) synchronized during last session are missing in remote folder, it has probably been reset (e.g. the app has been restarted).",
+		plan.missingFiles, plan.knownFiles)
+	logger.Warning("Local files are kept and uploaded instead of being deleted or replaced by remote versions.")
+	biased := SyncPlan{
+		Uploads: append(append(plan.Uploads, plan.LocalDeletes...), plan.Conflicts...),
+		RemoteDeletes: plan.RemoteDeletes,
+	}
+	for _, path := range plan.Downloads {
+		if s.localExists(path) {
+			biased.Uploads = append(biased.Uploads, path)
+		} else {
+			biased.Downloads = append(biased.Downloads, path)
+		}
+	}
+	sort.Strings(biased.Uploads)
+	return biased
+}
+
+// confirmLocalChanges asks before deleting local files or replacing them with remote versions, files which must not
+// be changed are left unresolved.
+func (s *Sync) confirmLocalChanges(plan SyncPlan) (SyncPlan, error) {
+	overwrites := make([]string, 0)
+	downloads := make([]string, 0)
+	for _, path := range plan.Downloads {
+		if s.localExists(path) {
+			overwrites = append(overwrites, path)
+		} else {
+			downloads = append(downloads, path)
+		}
+	}
+	if len(overwrites) == 0 && len(plan.LocalDeletes) == 0 {
+		return plan, nil
+	}
+	question := fmt.Sprintf("Delete %d local file(s) and replace %d local file(s) by their remote version?", len(plan.LocalDeletes), len(overwrites))
+	if s.dryRun {
+		logger.Info("[dry-run] Would ask: %s", question)
+		return plan, nil
+	}
+	confirmed, err := s.askConfirmation(question)
+	if err != nil || confirmed {
+		return plan, err
+	}
+	for _, path := range append(overwrites, plan.LocalDeletes...) {
+		logger.Warning("File '%s' has not been synchronized, local version is kept.", path)
+		s.unresolved[path] = true
+	}
+	plan.Downloads = downloads
+	plan.LocalDeletes = nil
+	return plan, nil
+}
+func (s Sync) localExists(path string) bool {
+	_, err := os.Lstat(s.ToLocalPath(path))
+	return err == nil
+}
+func (s *Sync) localChangedSince(path string, localStat os.FileInfo, fileState FileState, known bool) (bool, error) {
+	if !known {
+		return localStat != nil, nil
+	}
+	if localStat == nil {
+		return true, nil
+	}
+	if !fileState.LocalChanged(localStat) {
+		return false, nil
+	}
+	if fileState.Hash == "" || fileState.Size != localStat.Size() {
+		return true, nil
+	}
+	// file has only been touched
+	hash, err := HashFile(s.ToLocalPath(path))
+	if err != nil {
+		return false, err
+	}
+	return hash != fileState.Hash, nil
+}
+
+// applyPlan applies plan, files which fail to be transferred are left unresolved so that their state is not
+// recorded and they are compared again at next start.
+func (s *Sync) applyPlan(plan SyncPlan) error {
+	for _, path := range append(plan.Downloads, plan.Uploads...) {
+		delete(s.unresolved, path)
+	}
+	if len(plan.Downloads) > 0 {
+		err := s.containerFiler.DownloadFiles(s.sourceDir, s.targetDir, plan.Downloads)
+		if err != nil && !s.keepUnresolved(err, plan.Downloads) {
+			return err
+		}
+	}
+	if len(plan.Uploads) > 0 {
+		err := s.containerFiler.UploadFiles(s.sourceDir, s.targetDir, plan.Uploads)
+		if err != nil && !s.keepUnresolved(err, plan.Uploads) {
+			return err
+		}
+		for _, path := range plan.Uploads {
+			if !s.unresolved[path] {
+				s.uploaded(path)
+			}
+		}
+	}
+	for _, path := range plan.RemoteDeletes {
+		err := s.containerFiler.Delete(s.ToRemotePath(path))
+		if err != nil {
+			logger.Error(err.Error())
+			continue
+		}
+		s.uploaded(path)
+	}
+	for _, path := range plan.LocalDeletes {
+		if s.dryRun {
+			logger.Info("[dry-run] Would delete local path '%s'.", path)
+			continue
+		}
+		err := os.Remove(s.ToLocalPath(path))
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}
+	for _, path := range plan.Conflicts {
+		if !plan.resolveConflicts {
+			logger.Warning("File '%s' has not been synchronized, resolve the conflict manually.", path)
+			s.unresolved[path] = true
+			continue
+		}
+		err := s.applyConflict(path)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}
+	return nil
+}
+
+// keepUnresolved marks files which have failed as unresolved when only some of paths have failed, it gives false
+// when the whole operation has failed (e.g. connection can't be restored).
+func (s *Sync) keepUnresolved(err error, paths []string) bool {
+	if _, ok := err.(*FilesError); !ok {
+		return false
+	}
+	for _, path := range failedPaths(err, paths) {
+		logger.Warning("File '%s' has not been synchronized, it will be compared again at next start.", path)
+		s.unresolved[path] = true
+	}
+	return true
+}
+func (s *Sync) applyConflict(path string) error {
+	localPath := s.ToLocalPath(path)
+	remotePath := s.ToRemotePath(path)
+	localStat, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	remoteStat, err := s.containerFiler.Stat(remotePath)
+	if err != nil {
+		return err
+	}
+	policy, err := s.resolveConflict(localPath, localStat, remoteStat)
+	if err != nil {
+		return err
+	}
+	switch policy {
+	case CONFLICT_REMOTE_WINS:
+		return s.containerFiler.Download(remotePath, localPath)
+	case CONFLICT_KEEP_BOTH:
+		err = s.keepRemoteCopy(localPath)
+		if err != nil {
+			return err
+		}
+	}
+	return s.containerFiler.UploadFiles(s.sourceDir, s.targetDir, []string{path})
+}
+func (s Sync) isSameFile(path string, localStat, remoteStat os.FileInfo) (bool, error) {
+	if isSymlink(localStat) || isSymlink(remoteStat) {
+		return s.isSameSymlink(path, localStat, remoteStat)
+	}
+	if localStat.Size() != remoteStat.Size() {
+		return false, nil
+	}
+	if !s.checksum {
+		return localStat.ModTime().Unix() == remoteStat.ModTime().Unix(), nil
+	}
+	localHash, err := HashFile(s.ToLocalPath(path))
+	if err != nil {
+		return false, err
+	}
+	remoteHash, err := s.containerFiler.Hash(s.ToRemotePath(path))
+	if err != nil {
+		return false, err
+	}
+	return localHash == remoteHash, nil
+}
+
+// isSameSymlink tells if preserved symlinks point to the same target, modification time of symlinks can't be kept.
+func (s Sync) isSameSymlink(path string, localStat, remoteStat os.FileInfo) (bool, error) {
+	if !isSymlink(localStat) || !isSymlink(remoteStat) {
+		return false, nil
+	}
+	localTarget, err := os.Readlink(s.ToLocalPath(path))
+	if err != nil {
+		return false, err
+	}
+	remoteTarget, err := s.containerFiler.ReadLink(s.ToRemotePath(path))
+	if err != nil {
+		return false, err
+	}
+	return filepath.ToSlash(localTarget) == remoteTarget, nil
+}
+
+// listRemoteFiles lists files of remote folder, files which are never synchronized are left out like in
+// listLocalFiles.
+func (s Sync) listRemoteFiles() (map[string]os.FileInfo, error) {
+	files, err := s.containerFiler.ListRemoteFiles(s.targetDir)
+	if err != nil {
+		return nil, err
+	}
+	for path := range files {
+		if s.isIgnored(s.ToLocalPath(path)) {
+			delete(files, path)
+		}
+	}
+	return files, nil
+}
+func (s Sync) listLocalFiles() (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	err := s.walkLocal(s.sourceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == s.sourceDir {
+			return nil
+		}
+		if s.syncIgnore != nil && s.syncIgnore.Match(s.ToRemotePath(path), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || s.isIgnored(path) {
+			return nil
+		}
+		files[s.TrimPath(path)] = info
+		return nil
+	})
+	return files, err
+}
+func (s Sync) ToLocalPath(path string) string {
+	return s.sourceDir + string(os.PathSeparator) + filepath.FromSlash(strings.TrimPrefix(path, "/"))
+}
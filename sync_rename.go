@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/rjeczalik/notify"
+	"time"
+)
+
+// MOVE_PAIR_DELAY is the time to wait for the other side of a move. When it's not received, an old path has been
+// moved out of source folder and a new path has been moved in it.
+const MOVE_PAIR_DELAY = 500 * time.Millisecond
+
+// pendingMove is one side of a move waiting for the other one.
+type pendingMove struct {
+	path      string
+	movedFrom bool
+}
+
+// moveTimeoutEvent is sent when the other side of the move identified by cookie has not been received in time.
+type moveTimeoutEvent struct {
+	path   string
+	cookie uint32
+}
+
+func (e moveTimeoutEvent) Event() notify.Event {
+	return notify.Rename
+}
+func (e moveTimeoutEvent) Path() string {
+	return e.path
+}
+func (e moveTimeoutEvent) Sys() interface{} {
+	return nil
+}
+
+// isMoveEvent tells if the watcher has given a cookie to pair the event with the other side of its move.
+func isMoveEvent(ei notify.EventInfo) bool {
+	_, _, ok := moveCookie(ei)
+	return ok
+}
+
+// move pairs both sides of a move by the cookie given by the watcher, they are not always received in order.
+// The first side waits for the other one during MOVE_PAIR_DELAY.
+func (s *Sync) move(path string, cookie uint32, movedFrom bool) error {
+	other, ok := s.moves[cookie]
+	if !ok || other.movedFrom == movedFrom {
+		s.moves[cookie] = pendingMove{path: path, movedFrom: movedFrom}
+		go func() {
+			time.Sleep(MOVE_PAIR_DELAY)
+			s.eventChan <- moveTimeoutEvent{path: path, cookie: cookie}
+		}()
+		return nil
+	}
+	delete(s.moves, cookie)
+	if movedFrom {
+		return s.rename(path, other.path)
+	}
+	return s.rename(other.path, path)
+}
+
+// unpairedMove handles a side of a move which has not been paired in time, an old path is removed from container
+// and a new path is sent to it.
+func (s *Sync) unpairedMove(event moveTimeoutEvent) error {
+	pending, ok := s.moves[event.cookie]
+	if !ok || pending.path != event.path {
+		return nil
+	}
+	delete(s.moves, event.cookie)
+	if _, isEditorFile := s.editorFile(pending.path); isEditorFile {
+		return nil
+	}
+	if !pending.movedFrom {
+		return s.moveIn(pending.path)
+	}
+	logger.Info("Path '%s' has been moved out of source folder.", TruncatePath(pending.path))
+	return s.delete(pending.path)
+}
+
+// rename renames oldPath to path in container, an empty folder tracked in state is tracked under its new path.
+// Moves made by editors to save a file send the saved file instead.
+func (s *Sync) rename(oldPath, path string) error {
+	handled, err := s.editorRename(oldPath, path)
+	if handled {
+		return err
+	}
+	if s.replacedByMove(oldPath, path) {
+		logger.Info("File '%s' has been replaced by '%s', update sent.", TruncatePath(path), TruncatePath(oldPath))
+		return s.upload(path, true)
+	}
+	err = s.containerFiler.Rename(s.ToRemotePath(oldPath), s.ToRemotePath(path))
+	if err != nil {
+		return err
+	}
+	if permissions, ok := s.state.Dirs()[s.TrimPath(oldPath)]; ok {
+		s.state.DeleteDir(s.TrimPath(oldPath))
+		s.state.SetDir(s.TrimPath(path), permissions)
+	}
+	s.synced(oldPath, path)
+	s.uploaded(oldPath, path)
+	return nil
+}
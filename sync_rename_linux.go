@@ -0,0 +1,24 @@
+// +build linux
+
+package main
+
+import (
+	"github.com/rjeczalik/notify"
+	"golang.org/x/sys/unix"
+)
+
+// moveCookie gives the cookie set by inotify on both IN_MOVED_FROM and IN_MOVED_TO events of a move,
+// movedFrom tells if the event is for the old path.
+func moveCookie(ei notify.EventInfo) (cookie uint32, movedFrom bool, ok bool) {
+	sys, isInotify := ei.Sys().(*unix.InotifyEvent)
+	if !isInotify || sys == nil || sys.Cookie == 0 {
+		return 0, false, false
+	}
+	switch {
+	case sys.Mask & unix.IN_MOVED_FROM != 0:
+		return sys.Cookie, true, true
+	case sys.Mask & unix.IN_MOVED_TO != 0:
+		return sys.Cookie, false, true
+	}
+	return 0, false, false
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package main
+
+import (
+	"github.com/rjeczalik/notify"
+)
+
+// moveCookie is only available with inotify, other watchers don't give a cookie to pair both sides of a move
+// and Sync.Rename guesses them.
+func moveCookie(ei notify.EventInfo) (cookie uint32, movedFrom bool, ok bool) {
+	return 0, false, false
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	STATE_FILENAME       = ".sync-state.json"
+	STATE_VERSION        = 1
+	STATE_SAVE_INTERVAL  = 2 * time.Second
+)
+
+// FileState is the fingerprint of a file, in source folder and in remote folder, at its last synchronization.
+type FileState struct {
+	Size          int64     `json:"size"`
+	ModTime       time.Time `json:"mod_time"`
+	Hash          string    `json:"hash,omitempty"`
+	RemoteSize    int64     `json:"remote_size"`
+	RemoteModTime time.Time `json:"remote_mod_time"`
+}
+
+func NewFileState(localStat, remoteStat os.FileInfo) FileState {
+	return FileState{
+		Size: localStat.Size(),
+		ModTime: localStat.ModTime(),
+		RemoteSize: remoteStat.Size(),
+		RemoteModTime: remoteStat.ModTime(),
+	}
+}
+func (f FileState) LocalChanged(localStat os.FileInfo) bool {
+	return f.Size != localStat.Size() || f.ModTime.Unix() != localStat.ModTime().Unix()
+}
+func (f FileState) RemoteChanged(remoteStat os.FileInfo) bool {
+	return f.RemoteSize != remoteStat.Size() || f.RemoteModTime.Unix() != remoteStat.ModTime().Unix()
+}
+
+type syncStateFile struct {
+	Version int                    `json:"version"`
+	Files   map[string]FileState   `json:"files"`
+	Dirs    map[string]os.FileMode `json:"dirs,omitempty"`
+}
+
+// SyncState records state of synchronized files and permissions of empty folders, which are not
+// seen when files are compared.
+type SyncState struct {
+	files map[string]FileState
+	dirs  map[string]os.FileMode
+	dirty bool
+	mutex *sync.Mutex
+	saveMutex *sync.Mutex
+}
+
+func NewSyncState() *SyncState {
+	return &SyncState{
+		files: make(map[string]FileState),
+		dirs: make(map[string]os.FileMode),
+		mutex: &sync.Mutex{},
+		saveMutex: &sync.Mutex{},
+	}
+}
+func (s *SyncState) Get(path string) (FileState, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	fileState, ok := s.files[path]
+	return fileState, ok
+}
+func (s *SyncState) Set(path string, fileState FileState) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.files[path] = fileState
+	s.dirty = true
+}
+func (s *SyncState) Delete(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.files[path]; !ok {
+		return
+	}
+	delete(s.files, path)
+	s.dirty = true
+}
+func (s *SyncState) Paths() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	paths := make([]string, 0, len(s.files))
+	for path := range s.files {
+		paths = append(paths, path)
+	}
+	return paths
+}
+func (s *SyncState) SetDir(path string, permissions os.FileMode) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if current, ok := s.dirs[path]; ok && current == permissions {
+		return
+	}
+	s.dirs[path] = permissions
+	s.dirty = true
+}
+func (s *SyncState) DeleteDir(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.dirs[path]; !ok {
+		return
+	}
+	delete(s.dirs, path)
+	s.dirty = true
+}
+
+// Dirs gives permissions of empty folders by path.
+func (s *SyncState) Dirs() map[string]os.FileMode {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	dirs := make(map[string]os.FileMode, len(s.dirs))
+	for path, permissions := range s.dirs {
+		dirs[path] = permissions
+	}
+	return dirs
+}
+func (s *SyncState) IsEmpty() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.files) == 0
+}
+
+// Load reads state saved by a previous session, a missing file gives an empty state.
+func (s *SyncState) Load(stateFile string) error {
+	b, err := ioutil.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var content syncStateFile
+	err = json.Unmarshal(b, &content)
+	if err != nil {
+		return err
+	}
+	if content.Version != STATE_VERSION || content.Files == nil {
+		logger.Warning("State file '%s' has been written by another version, it is ignored.", TruncatePath(stateFile))
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.files = content.Files
+	s.dirs = content.Dirs
+	if s.dirs == nil {
+		s.dirs = make(map[string]os.FileMode)
+	}
+	s.dirty = false
+	return nil
+}
+
+// Save writes state if it has changed since last save, file is written atomically to not be left half-written.
+// State stays dirty when writing has failed, so it's written again at next save.
+func (s *SyncState) Save(stateFile string) error {
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+	s.mutex.Lock()
+	if !s.dirty {
+		s.mutex.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(syncStateFile{
+		Version: STATE_VERSION,
+		Files: s.files,
+		Dirs: s.dirs,
+	})
+	if err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+	// reset before writing to keep changes made while writing, it's set again if writing fails
+	s.dirty = false
+	s.mutex.Unlock()
+	tmpFile := stateFile + ".tmp"
+	err = ioutil.WriteFile(tmpFile, b, 0644)
+	if err == nil {
+		err = os.Rename(tmpFile, stateFile)
+	}
+	if err != nil {
+		s.mutex.Lock()
+		s.dirty = true
+		s.mutex.Unlock()
+	}
+	return err
+}
+
+// AutoSave saves state at each interval until stopCh is closed.
+func (s *SyncState) AutoSave(stateFile string, interval time.Duration, stopCh chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+		err := s.Save(stateFile)
+		if err != nil {
+			logger.Error("Saving state has errored: " + err.Error())
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
 	"path/filepath"
 	"strings"
 	"os"
@@ -24,4 +27,25 @@ func FileExists(path string) (bool, error) {
 		return false, nil
 	}
 	return true, err
-}
\ No newline at end of file
+}
+func HashContent(reader io.Reader) (string, error) {
+	h := md5.New()
+	_, err := io.Copy(h, reader)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return HashContent(f)
+}
+
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}